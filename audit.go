@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+const (
+	auditDecisionInjected = "injected"
+	auditDecisionSkipped  = "skipped"
+
+	// auditPrefix sets audit lines apart from the regular log when both are
+	// written to stderr.
+	auditPrefix = "audit: "
+)
+
+// auditLogger writes one json line per injection decision, independent of
+// the log verbosity.
+type auditLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	prefix string
+}
+
+// newAuditLogger appends the audit log to the file at path, or writes it to
+// stderr with auditPrefix when path is empty.
+func newAuditLogger(path string) (*auditLogger, error) {
+	if path == "" {
+		return &auditLogger{out: os.Stderr, prefix: auditPrefix}, nil
+	}
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLogger{out: f}, nil
+}
+
+// auditEntry fields are kept in alphabetical order so the json is stable.
+type auditEntry struct {
+	Decision  string `json:"decision"`
+	Name      string `json:"name"`
+	Namespace string `json:"namespace"`
+	Reason    string `json:"reason,omitempty"`
+	Timestamp string `json:"timestamp"`
+	Version   string `json:"version"`
+}
+
+// record writes the decision taken for the pod.
+func (a *auditLogger) record(pod *corev1.Pod, decision, reason string, c *config) {
+	line, err := json.Marshal(auditEntry{
+		Decision:  decision,
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		Reason:    reason,
+		Timestamp: time.Now().UTC().Format(time.RFC3339),
+		Version:   c.version,
+	})
+	if err != nil {
+		V(0).PodPrintf(pod.Namespace, pod.Name, err, "error: failed to encode audit entry")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := io.WriteString(a.out, a.prefix+string(line)+"\n"); err != nil {
+		V(0).PodPrintf(pod.Namespace, pod.Name, err, "error: failed to write audit entry")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	tests := []struct {
+		name         string
+		annotations  map[string]string
+		data         map[string]string
+		wantDecision string
+		wantReason   string
+	}{
+		{
+			name:         "injected",
+			wantDecision: auditDecisionInjected,
+		},
+		{
+			name:         "skipped by annotation",
+			annotations:  map[string]string{injectAnnotation: "false"},
+			wantDecision: auditDecisionSkipped,
+			wantReason:   skipReasonAnnotation,
+		},
+		{
+			name:         "skipped by policy",
+			data:         map[string]string{"policy": policyDisabled},
+			wantDecision: auditDecisionSkipped,
+			wantReason:   skipReasonPolicy,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Annotations = tt.annotations
+
+			var out bytes.Buffer
+			podInitializer, _ := newTestInitializer(pod)
+			podInitializer.audit = &auditLogger{out: &out, prefix: auditPrefix}
+
+			data := map[string]string{"version": "abc123"}
+			for key, value := range tt.data {
+				data[key] = value
+			}
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, data)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+
+			lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %d audit lines, want 1:\n%s", len(lines), out.String())
+			}
+			if !strings.HasPrefix(lines[0], auditPrefix) {
+				t.Errorf("audit line %q does not start with %q", lines[0], auditPrefix)
+			}
+
+			var entry auditEntry
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[0], auditPrefix)), &entry); err != nil {
+				t.Fatalf("audit line is not json: %v", err)
+			}
+
+			want := auditEntry{
+				Decision:  tt.wantDecision,
+				Name:      testPodName,
+				Namespace: testNamespace,
+				Reason:    tt.wantReason,
+				Timestamp: entry.Timestamp,
+				Version:   "abc123",
+			}
+			if entry != want {
+				t.Errorf("got audit entry %+v, want %+v", entry, want)
+			}
+			if _, err := time.Parse(time.RFC3339, entry.Timestamp); err != nil {
+				t.Errorf("invalid timestamp %q: %v", entry.Timestamp, err)
+			}
+		})
+	}
+}
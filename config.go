@@ -0,0 +1,827 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/istio/pilot/tools/version"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/labels"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+)
+
+const defaultResyncPeriod = 30 * time.Second
+
+// revisionLabel selects the revision a pod is injected with.
+const revisionLabel = "istio.io/rev"
+
+const (
+	policyDisabled = "disabled"
+	policyEnabled  = "enabled"
+)
+
+// How the excludeOutboundPorts pod annotation combines with the configmap key.
+const (
+	excludePortsMerge   = "merge"
+	excludePortsReplace = "replace"
+)
+
+// Kinds of the resources listed in the requiredResources configmap key.
+const (
+	requiredConfigMap = "configmap"
+	requiredSecret    = "secret"
+)
+
+type config struct {
+	autoDetectIPRanges           bool
+	bootstrapConfigMap           string
+	caCertSecret                 string
+	cniEnabled                   bool
+	concurrency                  int
+	dnsNameservers               []string
+	dnsSearchDomains             []string
+	dryRun                       bool
+	enableCoreDump               bool
+	excludeInboundPorts          []string
+	excludeOutboundPorts         []string
+	excludeOutboundPortsMode     string
+	extraVolumeMounts            []corev1.VolumeMount
+	extraVolumes                 []corev1.Volume
+	hub                          string
+	imagePullPolicy              corev1.PullPolicy
+	imagePullSecrets             []string
+	includeIPRanges              string
+	initCPULimit                 *resource.Quantity
+	initCPURequest               *resource.Quantity
+	initMemoryLimit              *resource.Quantity
+	initMemoryRequest            *resource.Quantity
+	injectedAnnotations          map[string]string
+	injectedLabels               map[string]string
+	istioSystem                  string
+	meshConfig                   string
+	minTerminationGracePeriod    time.Duration
+	namespaceSelector            labels.Selector
+	podAnnotationsForSecurity    map[string]string
+	podSelector                  labels.Selector
+	policy                       string
+	preInjectionChecks           bool
+	proxyContainerName           string
+	proxyCPULimit                *resource.Quantity
+	proxyCPURequest              *resource.Quantity
+	proxyDrainDuration           time.Duration
+	proxyEnv                     []corev1.EnvVar
+	proxyImageOverride           string
+	proxyInitImageOverride       string
+	proxyMemoryLimit             *resource.Quantity
+	proxyMemoryRequest           *resource.Quantity
+	proxyReadOnlyRootFS          bool
+	proxyRunAsNonRoot            bool
+	readinessInitialDelaySeconds int32
+	readinessPeriodSeconds       int32
+	requiredResources            []string
+	requireFirst                 bool
+	resyncPeriod                 time.Duration
+	revisions                    map[string]revision
+	serviceClusterLabel          string
+	shareProcessNamespace        bool
+	sidecarProxyUID              int64
+	sidecarTemplate              *template.Template
+	skipOwnerKinds               []string
+	statusPort                   int
+	tag                          string
+	tokenAudience                string
+	tokenExpirationSeconds       int64
+	verbosity                    int
+	version                      string
+	waitForInitializers          []string
+	waitForInitializersTimeout   time.Duration
+}
+
+// revision overrides the proxy images for pods labeled with the revision name.
+type revision struct {
+	Hub        string `json:"hub"`
+	ProxyImage string `json:"proxyImage"`
+	Tag        string `json:"tag"`
+}
+
+// forPod returns the config to inject the pod with, applying the overrides of
+// the revision the pod is labeled with.
+func (c *config) forPod(pod *corev1.Pod) *config {
+	name, ok := pod.ObjectMeta.Labels[revisionLabel]
+	if !ok {
+		return c
+	}
+
+	r, ok := c.revisions[name]
+	if !ok {
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: unknown revision %s, using the base config", name)
+		return c
+	}
+
+	revised := *c
+	// A base proxyImage or proxyInitImage would take precedence over the
+	// revision's hub and tag, so they are not inherited once either is set.
+	if r.Hub != "" || r.Tag != "" {
+		revised.proxyImageOverride = ""
+		revised.proxyInitImageOverride = ""
+	}
+	if r.Hub != "" {
+		revised.hub = r.Hub
+	}
+	if r.Tag != "" {
+		revised.tag = r.Tag
+	}
+	if r.ProxyImage != "" {
+		revised.proxyImageOverride = r.ProxyImage
+	}
+	return &revised
+}
+
+// proxyImage returns the image of the injected proxy container, composed from
+// hub and tag unless the proxyImage configmap key overrides it.
+func (c *config) proxyImage() string {
+	if c.proxyImageOverride != "" {
+		return c.proxyImageOverride
+	}
+	return c.hub + "/proxy:" + c.tag
+}
+
+// proxyInitImage returns the image of the injected init container, composed
+// from hub and tag unless the proxyInitImage configmap key overrides it.
+func (c *config) proxyInitImage() string {
+	if c.proxyInitImageOverride != "" {
+		return c.proxyInitImageOverride
+	}
+	return c.hub + "/proxy_init:" + c.tag
+}
+
+// validate returns an aggregated error describing every invalid field.
+func (c *config) validate() error {
+	var errs []error
+
+	if c.sidecarProxyUID < 0 || c.sidecarProxyUID > 65535 {
+		errs = append(errs, fmt.Errorf("sidecarProxyUID %d is outside of the range 0-65535", c.sidecarProxyUID))
+	}
+
+	errs = append(errs, validatePorts("excludeInboundPorts", c.excludeInboundPorts)...)
+	errs = append(errs, validatePorts("excludeOutboundPorts", c.excludeOutboundPorts)...)
+
+	if c.statusPort < 1 || c.statusPort > 65535 {
+		errs = append(errs, fmt.Errorf("statusPort %d is outside of the range 1-65535", c.statusPort))
+	}
+
+	if c.readinessInitialDelaySeconds < 0 {
+		errs = append(errs, fmt.Errorf("readinessInitialDelaySeconds %d is negative", c.readinessInitialDelaySeconds))
+	}
+
+	if c.readinessPeriodSeconds < 1 {
+		errs = append(errs, fmt.Errorf("readinessPeriodSeconds %d must be at least 1", c.readinessPeriodSeconds))
+	}
+
+	// Render the template against an empty pod so that a broken template
+	// fails at load time instead of for every pod.
+	if c.sidecarTemplate != nil {
+		if _, err := renderSidecarTemplate(c.sidecarTemplate, &corev1.Pod{}, c); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	if c.tokenAudience != "" && c.tokenExpirationSeconds < 600 {
+		errs = append(errs, fmt.Errorf("tokenExpirationSeconds %d must be at least 600", c.tokenExpirationSeconds))
+	}
+
+	if c.verbosity < 0 {
+		errs = append(errs, fmt.Errorf("verbosity %d is negative", c.verbosity))
+	}
+
+	if c.concurrency < 0 {
+		errs = append(errs, fmt.Errorf("concurrency %d is negative", c.concurrency))
+	}
+
+	if c.hub == "" {
+		errs = append(errs, fmt.Errorf("hub is empty"))
+	}
+
+	for _, ref := range c.requiredResources {
+		if _, _, err := parseRequiredResource(ref); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	switch c.imagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, fmt.Errorf("imagePullPolicy %q must be one of: %s, %s, %s", c.imagePullPolicy, corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever))
+	}
+
+	for kind := range c.podAnnotationsForSecurity {
+		if _, ok := securityAnnotationPrefixes[kind]; !ok {
+			errs = append(errs, fmt.Errorf("podAnnotationsForSecurity kind %q must be one of: %s, %s", kind, securityProfileAppArmor, securityProfileSeccomp))
+		}
+	}
+
+	// Pods are switched to the None DNS policy, which the API server rejects
+	// without a nameserver.
+	if len(c.dnsSearchDomains) > 0 && len(c.dnsNameservers) == 0 {
+		errs = append(errs, fmt.Errorf("dnsSearchDomains requires at least one dnsNameservers entry"))
+	}
+
+	// With requireFirst the initializers ahead are always waited for.
+	if len(c.waitForInitializers) > 0 && c.requireFirst {
+		errs = append(errs, fmt.Errorf("waitForInitializers requires requireFirst to be false"))
+	}
+
+	if c.policy != policyEnabled && c.policy != policyDisabled {
+		errs = append(errs, fmt.Errorf("policy %q must be one of: %s, %s", c.policy, policyEnabled, policyDisabled))
+	}
+
+	if c.excludeOutboundPortsMode != excludePortsReplace && c.excludeOutboundPortsMode != excludePortsMerge {
+		errs = append(errs, fmt.Errorf("excludeOutboundPortsMode %q must be one of: %s, %s", c.excludeOutboundPortsMode, excludePortsReplace, excludePortsMerge))
+	}
+
+	return utilerrors.NewAggregate(errs)
+}
+
+// parseRequiredResource splits a requiredResources entry of the form
+// kind/name.
+func parseRequiredResource(ref string) (string, string, error) {
+	parts := strings.SplitN(ref, "/", 2)
+	if len(parts) != 2 || parts[1] == "" || (parts[0] != requiredConfigMap && parts[0] != requiredSecret) {
+		return "", "", fmt.Errorf("requiredResources entry %q must be of the form %s/<name> or %s/<name>", ref, requiredConfigMap, requiredSecret)
+	}
+	return parts[0], parts[1], nil
+}
+
+func validatePorts(key string, ports []string) []error {
+	var errs []error
+	for _, port := range ports {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			errs = append(errs, fmt.Errorf("%s contains invalid port %q", key, port))
+		}
+	}
+	return errs
+}
+
+// configmapToConfig builds a config from the configmap data. When several
+// configmaps are given their data is merged in order, later configmaps
+// overriding earlier ones. Missing fields fall back to their defaults, fields
+// that are present but cannot be parsed are an error.
+func configmapToConfig(configmaps ...*corev1.ConfigMap) (*config, error) {
+	c := mergeConfigMaps(configmaps)
+
+	dryRun, err := parseBool(c.Data, "dryRun", false)
+	if err != nil {
+		return nil, err
+	}
+
+	enableCoreDump, err := parseBool(c.Data, "enableCoreDump", false)
+	if err != nil {
+		return nil, err
+	}
+
+	shareProcessNamespace, err := parseBool(c.Data, "shareProcessNamespace", false)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecarProxyUID, err := parseInt64(c.Data, "sidecarProxyUID", 1337)
+	if err != nil {
+		return nil, err
+	}
+
+	verbosity, err := parseInt(c.Data, "verbosity", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	concurrency, err := parseInt(c.Data, "concurrency", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	namespaceSelector, err := labels.Parse(c.Data["namespaceSelector"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespaceSelector %q: %v", c.Data["namespaceSelector"], err)
+	}
+
+	podSelector, err := labels.Parse(c.Data["podSelector"])
+	if err != nil {
+		return nil, fmt.Errorf("invalid podSelector %q: %v", c.Data["podSelector"], err)
+	}
+
+	proxyCPURequest, err := parseQuantity(c.Data, "proxyCPURequest")
+	if err != nil {
+		return nil, err
+	}
+
+	proxyMemoryRequest, err := parseQuantity(c.Data, "proxyMemoryRequest")
+	if err != nil {
+		return nil, err
+	}
+
+	proxyCPULimit, err := parseQuantity(c.Data, "proxyCPULimit")
+	if err != nil {
+		return nil, err
+	}
+
+	proxyMemoryLimit, err := parseQuantity(c.Data, "proxyMemoryLimit")
+	if err != nil {
+		return nil, err
+	}
+
+	initCPURequest, err := parseQuantity(c.Data, "initCPURequest")
+	if err != nil {
+		return nil, err
+	}
+
+	initMemoryRequest, err := parseQuantity(c.Data, "initMemoryRequest")
+	if err != nil {
+		return nil, err
+	}
+
+	initCPULimit, err := parseQuantity(c.Data, "initCPULimit")
+	if err != nil {
+		return nil, err
+	}
+
+	initMemoryLimit, err := parseQuantity(c.Data, "initMemoryLimit")
+	if err != nil {
+		return nil, err
+	}
+
+	proxyReadOnlyRootFS, err := parseBool(c.Data, "proxyReadOnlyRootFS", false)
+	if err != nil {
+		return nil, err
+	}
+
+	proxyRunAsNonRoot, err := parseBool(c.Data, "proxyRunAsNonRoot", false)
+	if err != nil {
+		return nil, err
+	}
+
+	readinessInitialDelaySeconds, err := parseInt(c.Data, "readinessInitialDelaySeconds", 1)
+	if err != nil {
+		return nil, err
+	}
+
+	readinessPeriodSeconds, err := parseInt(c.Data, "readinessPeriodSeconds", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	statusPort, err := parseInt(c.Data, "statusPort", 15020)
+	if err != nil {
+		return nil, err
+	}
+
+	sidecarTemplate, err := parseSidecarTemplate(c.Data["template"])
+	if err != nil {
+		return nil, err
+	}
+
+	requireFirst, err := parseBool(c.Data, "requireFirst", true)
+	if err != nil {
+		return nil, err
+	}
+
+	preInjectionChecks, err := parseBool(c.Data, "preInjectionChecks", false)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sidecars are almost always wrong in node agents. An explicitly empty
+	// skipOwnerKinds injects pods of every owner kind.
+	skipOwnerKinds, ok := c.Data["skipOwnerKinds"]
+	if !ok {
+		skipOwnerKinds = "DaemonSet"
+	}
+
+	// An explicitly empty tokenAudience disables the token volume.
+	tokenAudience, ok := c.Data["tokenAudience"]
+	if !ok {
+		tokenAudience = "istio-ca"
+	}
+
+	tokenExpirationSeconds, err := parseInt64(c.Data, "tokenExpirationSeconds", 43200)
+	if err != nil {
+		return nil, err
+	}
+
+	extraVolumes, err := parseExtraVolumes(c.Data["extraVolumes"])
+	if err != nil {
+		return nil, err
+	}
+
+	extraVolumeMounts, err := parseExtraVolumeMounts(c.Data["extraVolumeMounts"])
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make(map[string]revision)
+	if err := yaml.Unmarshal([]byte(c.Data["revisions"]), &revisions); err != nil {
+		return nil, fmt.Errorf("invalid revisions: %v", err)
+	}
+
+	resyncPeriod := parseDuration(c.Data, "resyncPeriod", defaultResyncPeriod)
+
+	autoDetectIPRanges, err := parseBool(c.Data, "autoDetectIPRanges", false)
+	if err != nil {
+		return nil, err
+	}
+
+	cniEnabled, err := parseBool(c.Data, "cniEnabled", false)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &config{
+		autoDetectIPRanges:           autoDetectIPRanges,
+		caCertSecret:                 c.Data["caCertSecret"],
+		cniEnabled:                   cniEnabled,
+		concurrency:                  concurrency,
+		dnsNameservers:               parseList(c.Data["dnsNameservers"]),
+		dnsSearchDomains:             parseList(c.Data["dnsSearchDomains"]),
+		dryRun:                       dryRun,
+		enableCoreDump:               enableCoreDump,
+		excludeInboundPorts:          parseList(c.Data["excludeInboundPorts"]),
+		excludeOutboundPorts:         parseList(c.Data["excludeOutboundPorts"]),
+		excludeOutboundPortsMode:     c.Data["excludeOutboundPortsMode"],
+		extraVolumeMounts:            extraVolumeMounts,
+		extraVolumes:                 extraVolumes,
+		hub:                          c.Data["hub"],
+		imagePullPolicy:              corev1.PullPolicy(c.Data["imagePullPolicy"]),
+		imagePullSecrets:             parseList(c.Data["imagePullSecrets"]),
+		includeIPRanges:              c.Data["includeIPRanges"],
+		initCPULimit:                 initCPULimit,
+		initCPURequest:               initCPURequest,
+		initMemoryLimit:              initMemoryLimit,
+		initMemoryRequest:            initMemoryRequest,
+		injectedAnnotations:          parseMap(c.Data, "injectedAnnotations"),
+		injectedLabels:               parseMap(c.Data, "injectedLabels"),
+		istioSystem:                  c.Data["istioSystem"],
+		meshConfig:                   c.Data["meshConfig"],
+		minTerminationGracePeriod:    parseDuration(c.Data, "minTerminationGracePeriod", 0),
+		namespaceSelector:            namespaceSelector,
+		podAnnotationsForSecurity:    parseMap(c.Data, "podAnnotationsForSecurity"),
+		podSelector:                  podSelector,
+		policy:                       c.Data["policy"],
+		preInjectionChecks:           preInjectionChecks,
+		proxyContainerName:           c.Data["proxyContainerName"],
+		proxyCPULimit:                proxyCPULimit,
+		proxyCPURequest:              proxyCPURequest,
+		proxyDrainDuration:           parseDuration(c.Data, "proxyDrainDuration", 5*time.Second),
+		proxyEnv:                     parseEnv(c.Data, "proxyEnv"),
+		proxyImageOverride:           c.Data["proxyImage"],
+		proxyInitImageOverride:       c.Data["proxyInitImage"],
+		proxyMemoryLimit:             proxyMemoryLimit,
+		proxyMemoryRequest:           proxyMemoryRequest,
+		proxyReadOnlyRootFS:          proxyReadOnlyRootFS,
+		proxyRunAsNonRoot:            proxyRunAsNonRoot,
+		readinessInitialDelaySeconds: int32(readinessInitialDelaySeconds),
+		readinessPeriodSeconds:       int32(readinessPeriodSeconds),
+		requiredResources:            parseList(c.Data["requiredResources"]),
+		requireFirst:                 requireFirst,
+		resyncPeriod:                 resyncPeriod,
+		revisions:                    revisions,
+		serviceClusterLabel:          c.Data["serviceClusterLabel"],
+		shareProcessNamespace:        shareProcessNamespace,
+		sidecarProxyUID:              sidecarProxyUID,
+		sidecarTemplate:              sidecarTemplate,
+		skipOwnerKinds:               parseList(skipOwnerKinds),
+		statusPort:                   statusPort,
+		tag:                          c.Data["tag"],
+		tokenAudience:                tokenAudience,
+		tokenExpirationSeconds:       tokenExpirationSeconds,
+		verbosity:                    verbosity,
+		version:                      c.Data["version"],
+		waitForInitializers:          parseList(c.Data["waitForInitializers"]),
+		waitForInitializersTimeout:   parseDuration(c.Data, "waitForInitializersTimeout", 30*time.Second),
+	}
+
+	// Experimental behaviors configured without their feature gate are ignored.
+	if (len(cfg.dnsNameservers) > 0 || len(cfg.dnsSearchDomains) > 0) && !featureEnabled(featureDNSConfig) {
+		log.Printf("warning: ignoring dnsNameservers and dnsSearchDomains, the %s feature gate is disabled", featureDNSConfig)
+		cfg.dnsNameservers, cfg.dnsSearchDomains = nil, nil
+	}
+
+	if cfg.proxyReadOnlyRootFS && !featureEnabled(featureProxyReadOnlyRootFS) {
+		log.Printf("warning: ignoring proxyReadOnlyRootFS, the %s feature gate is disabled", featureProxyReadOnlyRootFS)
+		cfg.proxyReadOnlyRootFS = false
+	}
+
+	if cfg.shareProcessNamespace && !featureEnabled(featureShareProcessNamespace) {
+		log.Printf("warning: ignoring shareProcessNamespace, the %s feature gate is disabled", featureShareProcessNamespace)
+		cfg.shareProcessNamespace = false
+	}
+
+	if cfg.serviceClusterLabel == "" {
+		cfg.serviceClusterLabel = "app"
+	}
+
+	if cfg.proxyContainerName == "" {
+		cfg.proxyContainerName = defaultProxyContainerName
+	}
+
+	// The init container is short-lived, small requests keep it admissible
+	// under a LimitRange.
+	if cfg.initCPURequest == nil {
+		q := resource.MustParse("10m")
+		cfg.initCPURequest = &q
+	}
+
+	if cfg.initMemoryRequest == nil {
+		q := resource.MustParse("10Mi")
+		cfg.initMemoryRequest = &q
+	}
+
+	if cfg.imagePullPolicy == "" {
+		cfg.imagePullPolicy = corev1.PullIfNotPresent
+	}
+
+	if cfg.policy == "" {
+		cfg.policy = policyEnabled
+	}
+
+	if cfg.excludeOutboundPortsMode == "" {
+		cfg.excludeOutboundPortsMode = excludePortsReplace
+	}
+
+	if cfg.caCertSecret == "" {
+		cfg.caCertSecret = "istio.default"
+	}
+
+	if cfg.hub == "" {
+		cfg.hub = "docker.io/istio"
+	}
+
+	if cfg.istioSystem == "" {
+		cfg.istioSystem = "istio-system"
+	}
+
+	if cfg.meshConfig == "" {
+		cfg.meshConfig = "istio"
+	}
+
+	if cfg.tag == "" {
+		cfg.tag = "0.1"
+	}
+
+	if len(cfg.requiredResources) == 0 {
+		cfg.requiredResources = []string{
+			requiredConfigMap + "/" + cfg.meshConfig,
+			requiredSecret + "/" + cfg.caCertSecret,
+		}
+	}
+
+	if cfg.version == "" {
+		cfg.version = version.Line()
+	}
+
+	return cfg, nil
+}
+
+func parseBool(data map[string]string, key string, defaultValue bool) (bool, error) {
+	value, ok := data[key]
+	if !ok || value == "" {
+		V(4).Printf("%s not set, using default: %t", key, defaultValue)
+		return defaultValue, nil
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return b, nil
+}
+
+func parseInt64(data map[string]string, key string, defaultValue int64) (int64, error) {
+	value, ok := data[key]
+	if !ok || value == "" {
+		V(4).Printf("%s not set, using default: %d", key, defaultValue)
+		return defaultValue, nil
+	}
+
+	i, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return i, nil
+}
+
+func parseInt(data map[string]string, key string, defaultValue int) (int, error) {
+	value, ok := data[key]
+	if !ok || value == "" {
+		V(4).Printf("%s not set, using default: %d", key, defaultValue)
+		return defaultValue, nil
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return i, nil
+}
+
+// parseDuration falls back to the default with a warning when the value
+// cannot be parsed or is negative.
+func parseDuration(data map[string]string, key string, defaultValue time.Duration) time.Duration {
+	value, ok := data[key]
+	if !ok || value == "" {
+		V(4).Printf("%s not set, using default: %v", key, defaultValue)
+		return defaultValue
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("warning: invalid %s %q, using default %v: %v", key, value, defaultValue, err)
+		return defaultValue
+	}
+	if d < 0 {
+		log.Printf("warning: negative %s %q, using default %v", key, value, defaultValue)
+		return defaultValue
+	}
+	return d
+}
+
+// parseEnv parses a comma-separated list of KEY=VALUE pairs. Malformed pairs
+// are skipped with a warning.
+func parseEnv(data map[string]string, key string) []corev1.EnvVar {
+	var env []corev1.EnvVar
+	for _, pair := range parseList(data[key]) {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			log.Printf("warning: skipping malformed %s entry %q, expected KEY=VALUE", key, pair)
+			continue
+		}
+		env = append(env, corev1.EnvVar{Name: name, Value: parts[1]})
+	}
+	return env
+}
+
+// parseMap parses a comma-separated list of key=value pairs. Malformed pairs
+// are skipped with a warning.
+func parseMap(data map[string]string, key string) map[string]string {
+	m := make(map[string]string)
+	for _, pair := range parseList(data[key]) {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 || name == "" {
+			log.Printf("warning: skipping malformed %s entry %q, expected key=value", key, pair)
+			continue
+		}
+		m[name] = strings.TrimSpace(parts[1])
+	}
+	return m
+}
+
+// parseExtraVolumes parses a YAML list of volumes. Volumes with a name that is
+// already in the list are skipped with a warning.
+func parseExtraVolumes(value string) ([]corev1.Volume, error) {
+	var volumes []corev1.Volume
+	if err := yaml.Unmarshal([]byte(value), &volumes); err != nil {
+		return nil, fmt.Errorf("invalid extraVolumes: %v", err)
+	}
+
+	var unique []corev1.Volume
+	for _, volume := range volumes {
+		if volume.Name == "" {
+			return nil, fmt.Errorf("invalid extraVolumes: volume has no name")
+		}
+		if hasVolume(unique, volume.Name) {
+			log.Printf("warning: skipping duplicate extraVolumes entry %s", volume.Name)
+			continue
+		}
+		unique = append(unique, volume)
+	}
+	return unique, nil
+}
+
+// parseExtraVolumeMounts parses a YAML list of volume mounts. Mounts of a
+// volume that is already mounted are skipped with a warning.
+func parseExtraVolumeMounts(value string) ([]corev1.VolumeMount, error) {
+	var mounts []corev1.VolumeMount
+	if err := yaml.Unmarshal([]byte(value), &mounts); err != nil {
+		return nil, fmt.Errorf("invalid extraVolumeMounts: %v", err)
+	}
+
+	var unique []corev1.VolumeMount
+	for _, mount := range mounts {
+		if mount.Name == "" || mount.MountPath == "" {
+			return nil, fmt.Errorf("invalid extraVolumeMounts: mount %q needs a name and a mountPath", mount.Name)
+		}
+		if hasVolumeMount(unique, mount.Name) {
+			log.Printf("warning: skipping duplicate extraVolumeMounts entry %s", mount.Name)
+			continue
+		}
+		unique = append(unique, mount)
+	}
+	return unique, nil
+}
+
+// loadConfigFile builds a config from a YAML or JSON file holding the same
+// keys as the configmap data.
+func loadConfigFile(path string) (*config, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values map[string]interface{}
+	if err := yaml.Unmarshal(raw, &values); err != nil {
+		return nil, err
+	}
+
+	data := make(map[string]string, len(values))
+	for key, value := range values {
+		if value == nil {
+			continue
+		}
+		s, err := configFileValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", key, err)
+		}
+		data[key] = s
+	}
+	return configmapToConfig(&corev1.ConfigMap{Data: data})
+}
+
+// configFileValue converts a config file value to its configmap string.
+// Unquoted numbers and booleans are accepted as well as strings, and nested
+// values such as revisions are written back as YAML.
+func configFileValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case float64:
+		// YAML numbers decode as float64, which fmt would print as 1e+06.
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	default:
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return "", err
+		}
+		return string(out), nil
+	}
+}
+
+// mergeConfigMaps returns a configmap holding the data of all configmaps,
+// later configmaps overriding earlier ones.
+func mergeConfigMaps(configmaps []*corev1.ConfigMap) *corev1.ConfigMap {
+	merged := &corev1.ConfigMap{Data: make(map[string]string)}
+	for _, cm := range configmaps {
+		for key, value := range cm.Data {
+			merged.Data[key] = value
+		}
+	}
+	return merged
+}
+
+// parseList splits a comma-separated list, dropping empty entries.
+func parseList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// parseQuantity returns nil when key is not set so that the corresponding
+// request or limit is omitted rather than set to zero.
+func parseQuantity(data map[string]string, key string) (*resource.Quantity, error) {
+	value, ok := data[key]
+	if !ok || value == "" {
+		return nil, nil
+	}
+
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s %q: %v", key, value, err)
+	}
+	return &q, nil
+}
@@ -0,0 +1,313 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+func TestConfigForPod(t *testing.T) {
+	c := newTestConfig(t, map[string]string{
+		"hub":            "docker.io/istio",
+		"tag":            "0.1",
+		"proxyImage":     "example.com/proxy:base",
+		"proxyInitImage": "example.com/proxy_init:base",
+		"revisions": `
+canary:
+  hub: docker.io/canary
+  tag: "0.2"
+pinned:
+  proxyImage: example.com/proxy:pinned
+`,
+	})
+
+	tests := []struct {
+		name          string
+		revision      string
+		wantImage     string
+		wantInitImage string
+	}{
+		{
+			name:          "base",
+			wantImage:     "example.com/proxy:base",
+			wantInitImage: "example.com/proxy_init:base",
+		},
+		{
+			name:          "matched revision",
+			revision:      "canary",
+			wantImage:     "docker.io/canary/proxy:0.2",
+			wantInitImage: "docker.io/canary/proxy_init:0.2",
+		},
+		{
+			name:          "revision overriding the proxy image",
+			revision:      "pinned",
+			wantImage:     "example.com/proxy:pinned",
+			wantInitImage: "example.com/proxy_init:base",
+		},
+		{
+			name:          "unknown revision",
+			revision:      "unknown",
+			wantImage:     "example.com/proxy:base",
+			wantInitImage: "example.com/proxy_init:base",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			if tt.revision != "" {
+				pod.Labels = map[string]string{revisionLabel: tt.revision}
+			}
+
+			revised := c.forPod(pod)
+			if got := revised.proxyImage(); got != tt.wantImage {
+				t.Errorf("got proxy image %q, want %q", got, tt.wantImage)
+			}
+			if got := revised.proxyInitImage(); got != tt.wantInitImage {
+				t.Errorf("got proxy init image %q, want %q", got, tt.wantInitImage)
+			}
+		})
+	}
+
+	// The base config is shared by every pod and must not be modified.
+	if got := c.proxyImage(); got != "example.com/proxy:base" {
+		t.Errorf("base config proxy image changed to %q", got)
+	}
+}
+
+func TestProxyResourceQuantities(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+	}{
+		{
+			name: "all set",
+			data: map[string]string{
+				"proxyCPURequest":    "250m",
+				"proxyMemoryRequest": "128Mi",
+				"proxyCPULimit":      "2",
+				"proxyMemoryLimit":   "1G",
+			},
+		},
+		{
+			name: "requests only",
+			data: map[string]string{
+				"proxyCPURequest":    "100m",
+				"proxyMemoryRequest": "64Mi",
+			},
+		},
+		{
+			name: "empty values",
+			data: map[string]string{
+				"proxyCPURequest": "",
+				"proxyCPULimit":   "500m",
+			},
+		},
+		{
+			name: "none",
+		},
+	}
+
+	keys := map[string]struct {
+		name  corev1.ResourceName
+		limit bool
+	}{
+		"proxyCPURequest":    {corev1.ResourceCPU, false},
+		"proxyMemoryRequest": {corev1.ResourceMemory, false},
+		"proxyCPULimit":      {corev1.ResourceCPU, true},
+		"proxyMemoryLimit":   {corev1.ResourceMemory, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resources := proxyContainer(newPendingPod(), newTestConfig(t, tt.data)).Resources
+
+			for key, resource := range keys {
+				list := resources.Requests
+				if resource.limit {
+					list = resources.Limits
+				}
+
+				q, ok := list[resource.name]
+				if tt.data[key] == "" {
+					if ok {
+						t.Errorf("%s is unset, got %s", key, q.String())
+					}
+					continue
+				}
+				if !ok {
+					t.Errorf("%s %q was not set", key, tt.data[key])
+					continue
+				}
+				if q.String() != tt.data[key] {
+					t.Errorf("%s: got %s, want %s", key, q.String(), tt.data[key])
+				}
+			}
+		})
+	}
+
+	if _, err := configmapToConfig(&corev1.ConfigMap{Data: map[string]string{"proxyMemoryLimit": "1 gig"}}); err == nil {
+		t.Error("got no error for an invalid quantity")
+	}
+}
+
+func TestProxyImages(t *testing.T) {
+	tests := []struct {
+		name          string
+		data          map[string]string
+		wantImage     string
+		wantInitImage string
+	}{
+		{
+			name:          "defaults",
+			wantImage:     "docker.io/istio/proxy:0.1",
+			wantInitImage: "docker.io/istio/proxy_init:0.1",
+		},
+		{
+			name:          "hub and tag",
+			data:          map[string]string{"hub": "registry.example.com/istio", "tag": "1.0"},
+			wantImage:     "registry.example.com/istio/proxy:1.0",
+			wantInitImage: "registry.example.com/istio/proxy_init:1.0",
+		},
+		{
+			name: "overrides",
+			data: map[string]string{
+				"hub":            "registry.example.com/istio",
+				"proxyImage":     "mirror.example.com/envoy:pinned",
+				"proxyInitImage": "mirror.example.com/iptables:pinned",
+			},
+			wantImage:     "mirror.example.com/envoy:pinned",
+			wantInitImage: "mirror.example.com/iptables:pinned",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, tt.data)
+			if got := c.proxyImage(); got != tt.wantImage {
+				t.Errorf("got proxy image %q, want %q", got, tt.wantImage)
+			}
+			if got := c.proxyInitImage(); got != tt.wantInitImage {
+				t.Errorf("got proxy init image %q, want %q", got, tt.wantInitImage)
+			}
+
+			pod := newPendingPod()
+			if got := proxyContainer(pod, c).Image; got != tt.wantImage {
+				t.Errorf("got proxy container image %q, want %q", got, tt.wantImage)
+			}
+			if got := initContainer(pod, c).Image; got != tt.wantInitImage {
+				t.Errorf("got init container image %q, want %q", got, tt.wantInitImage)
+			}
+		})
+	}
+}
+
+func TestConfigMapMerge(t *testing.T) {
+	base := &corev1.ConfigMap{Data: map[string]string{
+		"hub":             "docker.io/istio",
+		"tag":             "0.1",
+		"includeIPRanges": "10.0.0.0/8",
+	}}
+	override := &corev1.ConfigMap{Data: map[string]string{
+		"tag":             "0.2",
+		"includeIPRanges": "",
+	}}
+
+	c, err := configmapToConfig(base, override)
+	if err != nil {
+		t.Fatalf("configmapToConfig: %v", err)
+	}
+
+	if c.hub != "docker.io/istio" {
+		t.Errorf("got hub %q, want the base value", c.hub)
+	}
+	if c.tag != "0.2" {
+		t.Errorf("got tag %q, want the override", c.tag)
+	}
+	if c.includeIPRanges != "" {
+		t.Errorf("got includeIPRanges %q, want the empty override", c.includeIPRanges)
+	}
+
+	// The order of the configmaps decides, not their content.
+	c, err = configmapToConfig(override, base)
+	if err != nil {
+		t.Fatalf("configmapToConfig: %v", err)
+	}
+	if c.tag != "0.1" {
+		t.Errorf("got tag %q with the configmaps reversed, want 0.1", c.tag)
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	// The configmap data the files below are equivalent to.
+	want := newTestConfig(t, map[string]string{
+		"hub":                    "registry.example.com/istio",
+		"tag":                    "1.0",
+		"enableCoreDump":         "true",
+		"tokenExpirationSeconds": "1000000",
+		"proxyCPURequest":        "100m",
+		"revisions":              "canary:\n  tag: \"1.1\"\n",
+	})
+
+	files := map[string]string{
+		"config.yaml": `
+hub: registry.example.com/istio
+tag: "1.0"
+enableCoreDump: true
+tokenExpirationSeconds: 1000000
+proxyCPURequest: 100m
+revisions:
+  canary:
+    tag: "1.1"
+`,
+		"config.json": `{
+  "hub": "registry.example.com/istio",
+  "tag": "1.0",
+  "enableCoreDump": true,
+  "tokenExpirationSeconds": 1000000,
+  "proxyCPURequest": "100m",
+  "revisions": {"canary": {"tag": "1.1"}}
+}`,
+	}
+
+	dir, err := ioutil.TempDir("", "istio-initializer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := loadConfigFile(path)
+			if err != nil {
+				t.Fatalf("loadConfigFile: %v", err)
+			}
+			if err := got.validate(); err != nil {
+				t.Errorf("validate: %v", err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got config\n%+v\nwant\n%+v", got, want)
+			}
+		})
+	}
+}
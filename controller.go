@@ -0,0 +1,298 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+// maxRetries is the number of times a pod is retried before it is dropped
+// out of the queue.
+const maxRetries = 5
+
+// cacheSyncTimeout bounds the initial pod list, so that missing RBAC
+// permissions fail loudly instead of leaving the controller idle.
+const cacheSyncTimeout = 2 * time.Minute
+
+// controller watches uninitialized pods and queues them for initialization.
+type controller struct {
+	configs     *configStore
+	initializer *initializer
+
+	indexer  cache.Indexer
+	informer cache.Controller
+	queue    workqueue.RateLimitingInterface
+
+	// errorLog limits how often the same error is logged for a pod.
+	errorLog *errorLogLimiter
+
+	// leading is set once this replica holds the leader lock, synced once
+	// the initial pod list has been cached.
+	leading int32
+	synced  int32
+
+	// workers tracks the running workers so that shutdown can wait for
+	// in-flight pods.
+	workers sync.WaitGroup
+}
+
+// newController watches the pods of namespace, or of all namespaces when
+// namespace is empty.
+func newController(clientset *kubernetes.Clientset, namespace string, configs *configStore, podInitializer *initializer, resyncPeriod, errorLogInterval time.Duration) *controller {
+	watchlist := cache.NewListWatchFromClient(clientset.Core().RESTClient(), "pods", namespace, fields.Everything())
+
+	includeUninitializedWatchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			options.IncludeUninitialized = true
+			return watchlist.List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			options.IncludeUninitialized = true
+			return watchlist.Watch(options)
+		},
+	}
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+
+	indexer, informer := cache.NewIndexerInformer(includeUninitializedWatchlist, &corev1.Pod{}, resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				key, err := cache.MetaNamespaceKeyFunc(obj)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				queue.Add(key)
+			},
+			// Pods pending on another initializer ahead of this one become
+			// ready once that initializer removes itself, and resyncs retry
+			// pods that were dropped out of the queue.
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				newPod := newObj.(*corev1.Pod)
+
+				// Injected pods no longer list this initializer.
+				if !isPendingInitializer(newPod, podInitializer.name, false) {
+					return
+				}
+
+				key, err := cache.MetaNamespaceKeyFunc(newObj)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				queue.Add(key)
+			},
+		}, cache.Indexers{})
+
+	return &controller{
+		configs:     configs,
+		initializer: podInitializer,
+		indexer:     indexer,
+		informer:    informer,
+		queue:       queue,
+		errorLog:    newErrorLogLimiter(errorLogInterval),
+	}
+}
+
+// run starts the informer and the given number of workers and blocks until
+// stop is closed.
+func (ctrl *controller) run(workers int, stop <-chan struct{}) {
+	defer ctrl.queue.ShutDown()
+
+	atomic.StoreInt32(&ctrl.leading, 1)
+
+	go ctrl.informer.Run(stop)
+
+	log.Println("Waiting for the pod cache to sync...")
+	if !waitForCacheSync(stop, cacheSyncTimeout, ctrl.informer.HasSynced) {
+		select {
+		case <-stop:
+			return
+		default:
+			log.Fatalf("timed out after %v waiting for the pod cache to sync", cacheSyncTimeout)
+		}
+	}
+	atomic.StoreInt32(&ctrl.synced, 1)
+	log.Println("Pod cache synced")
+
+	for i := 0; i < workers; i++ {
+		ctrl.workers.Add(1)
+		go func() {
+			defer ctrl.workers.Done()
+			wait.Until(func() { ctrl.runWorker(stop) }, time.Second, stop)
+		}()
+	}
+
+	<-stop
+}
+
+// hasSynced reports whether the pod cache has synced and the workers are
+// processing pods.
+func (ctrl *controller) hasSynced() bool {
+	return atomic.LoadInt32(&ctrl.synced) == 1
+}
+
+// ready reports whether the replica is ready. Standby replicas are ready
+// right away, the leader once its pod cache has synced.
+func (ctrl *controller) ready() bool {
+	return atomic.LoadInt32(&ctrl.leading) == 0 || ctrl.hasSynced()
+}
+
+// waitForCacheSync waits for the caches to sync until stop is closed or the
+// timeout expires and reports whether they synced.
+func waitForCacheSync(stop <-chan struct{}, timeout time.Duration, cacheSyncs ...cache.InformerSynced) bool {
+	syncStop := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(syncStop)
+		select {
+		case <-stop:
+		case <-done:
+		case <-time.After(timeout):
+		}
+	}()
+
+	return cache.WaitForCacheSync(syncStop, cacheSyncs...)
+}
+
+// waitForWorkers waits up to timeout for the workers to finish the pods they
+// are processing and reports whether they did.
+func (ctrl *controller) waitForWorkers(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		ctrl.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (ctrl *controller) runWorker(stop <-chan struct{}) {
+	for ctrl.processNextItem(stop) {
+	}
+}
+
+func (ctrl *controller) processNextItem(stop <-chan struct{}) bool {
+	key, quit := ctrl.queue.Get()
+	if quit {
+		return false
+	}
+	defer ctrl.queue.Done(key)
+
+	// Once stopping, only the pods already in flight are finished.
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+
+	err := ctrl.syncPod(key.(string))
+	ctrl.handleErr(err, key)
+	return true
+}
+
+// syncPod looks the pod up from the local cache and initializes a copy of it.
+func (ctrl *controller) syncPod(key string) error {
+	obj, exists, err := ctrl.indexer.GetByKey(key)
+	if err != nil {
+		return err
+	}
+
+	// The pod was deleted before it was processed.
+	if !exists {
+		return nil
+	}
+
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return fmt.Errorf("unexpected object %T for key %s", obj, key)
+	}
+	return ctrl.initializer.initializePod(pod.DeepCopy(), ctrl.configs.get())
+}
+
+// requeueError is returned for a pod that is not ready to be initialized
+// yet. The pod is processed again after the delay without counting as a
+// failure.
+type requeueError struct {
+	reason string
+	after  time.Duration
+}
+
+func (e *requeueError) Error() string {
+	return fmt.Sprintf("%s, retrying in %v", e.reason, e.after)
+}
+
+// handleErr re-queues the pod with backoff on failure and drops it once it
+// has failed maxRetries times.
+func (ctrl *controller) handleErr(err error, key interface{}) {
+	if err == nil {
+		ctrl.queue.Forget(key)
+		return
+	}
+
+	namespace, name, _ := cache.SplitMetaNamespaceKey(key.(string))
+
+	// Errors are deduplicated by pod UID, falling back to the key when the
+	// pod is gone from the cache.
+	id := key.(string)
+	if obj, exists, _ := ctrl.indexer.GetByKey(id); exists {
+		if pod, ok := obj.(*corev1.Pod); ok {
+			id = string(pod.UID)
+		}
+	}
+	logErr := ctrl.errorLog.allow(id, err)
+
+	// Pods that are not ready yet are retried for as long as they stay
+	// pending, without counting against maxRetries.
+	if requeue, ok := err.(*requeueError); ok {
+		if logErr {
+			V(2).PodPrintf(namespace, name, nil, "%v", requeue)
+		}
+		ctrl.queue.Forget(key)
+		ctrl.queue.AddAfter(key, requeue.after)
+		return
+	}
+
+	if ctrl.queue.NumRequeues(key) < maxRetries {
+		if logErr {
+			V(2).PodPrintf(namespace, name, err, "error initializing pod, retrying")
+		}
+		ctrl.queue.AddRateLimited(key)
+		return
+	}
+
+	ctrl.queue.Forget(key)
+	if logErr {
+		V(0).PodPrintf(namespace, name, err, "error: dropping pod out of the queue")
+	}
+}
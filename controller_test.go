@@ -0,0 +1,57 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+func TestHandleErrLogsOnce(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	queue := workqueue.NewRateLimitingQueue(workqueue.DefaultControllerRateLimiter())
+	defer queue.ShutDown()
+
+	ctrl := &controller{
+		indexer:  cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{}),
+		queue:    queue,
+		errorLog: newErrorLogLimiter(time.Minute),
+	}
+	key := testNamespace + "/" + testPodName
+
+	// The retry delay shrinks as the wait times out, the same reason is
+	// still logged once.
+	for i := 0; i < 3; i++ {
+		ctrl.handleErr(&requeueError{reason: "waiting for initializers a.example.com", after: time.Duration(3-i) * time.Second}, key)
+	}
+	for i := 0; i < 3; i++ {
+		ctrl.handleErr(fmt.Errorf("update failed"), key)
+	}
+	ctrl.handleErr(&requeueError{reason: "waiting for initializers b.example.com", after: time.Second}, key)
+
+	for _, message := range []string{"a.example.com", "update failed", "b.example.com"} {
+		if got := strings.Count(out.String(), message); got != 1 {
+			t.Errorf("got %d log lines with %q, want 1:\n%s", got, message, out.String())
+		}
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+)
+
+// runDriftScan counts every interval the injected pods whose status
+// annotation records a config version other than the current one, until stop
+// is closed.
+func runDriftScan(clientset kubernetes.Interface, namespace string, configs *configStore, interval time.Duration, stop <-chan struct{}) {
+	wait.Until(func() {
+		outOfDate, err := countOutOfDatePods(clientset, namespace, configs.get().version)
+		if err != nil {
+			log.Printf("warning: failed to scan injected pods for config drift: %v", err)
+			return
+		}
+		V(2).Printf("%d injected pods are out of date", outOfDate)
+		podsOutOfDate.Set(float64(outOfDate))
+	}, interval, stop)
+}
+
+// countOutOfDatePods returns the number of pods in namespace injected with a
+// config version other than version.
+func countOutOfDatePods(clientset kubernetes.Interface, namespace, version string) (int, error) {
+	pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return 0, err
+	}
+
+	outOfDate := 0
+	for _, pod := range pods.Items {
+		value, ok := pod.ObjectMeta.Annotations[statusAnnotation]
+		if !ok {
+			continue
+		}
+
+		var status sidecarStatus
+		if err := json.Unmarshal([]byte(value), &status); err != nil {
+			V(2).PodPrintf(pod.Namespace, pod.Name, err, "ignoring invalid %s annotation", statusAnnotation)
+			continue
+		}
+		if status.Version != version {
+			outOfDate++
+		}
+	}
+	return outOfDate, nil
+}
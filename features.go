@@ -0,0 +1,81 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Experimental injection behaviors, all disabled unless enabled with the
+// -feature-gates flag.
+const (
+	featureDNSConfig             = "DNSConfig"
+	featureProxyReadOnlyRootFS   = "ProxyReadOnlyRootFS"
+	featureShareProcessNamespace = "ShareProcessNamespace"
+)
+
+var knownFeatures = []string{
+	featureDNSConfig,
+	featureProxyReadOnlyRootFS,
+	featureShareProcessNamespace,
+}
+
+// featureGates holds the gates enabled with the -feature-gates flag. It is
+// set once at startup, before the config is loaded.
+var featureGates = map[string]bool{}
+
+// setFeatureGates parses a comma-separated list of Name=bool pairs. Unknown
+// and malformed gates are skipped with a warning.
+func setFeatureGates(value string) {
+	gates := make(map[string]bool)
+	for _, pair := range parseList(value) {
+		parts := strings.SplitN(pair, "=", 2)
+		name := strings.TrimSpace(parts[0])
+		if len(parts) != 2 {
+			log.Printf("warning: skipping malformed feature gate %q, expected Name=bool", pair)
+			continue
+		}
+
+		enabled, err := strconv.ParseBool(strings.TrimSpace(parts[1]))
+		if err != nil {
+			log.Printf("warning: skipping feature gate %s with invalid value %q", name, parts[1])
+			continue
+		}
+
+		if !isKnownFeature(name) {
+			log.Printf("warning: skipping unknown feature gate %s, known gates: %s", name, strings.Join(knownFeatures, ", "))
+			continue
+		}
+		gates[name] = enabled
+	}
+
+	for name, enabled := range gates {
+		log.Printf("Feature gate %s set to: %v", name, enabled)
+	}
+	featureGates = gates
+}
+
+func isKnownFeature(name string) bool {
+	for _, known := range knownFeatures {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// featureEnabled reports whether the named feature gate is enabled.
+func featureEnabled(name string) bool {
+	return featureGates[name]
+}
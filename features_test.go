@@ -0,0 +1,52 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSetFeatureGates(t *testing.T) {
+	defer withFeatureGates("")()
+
+	setFeatureGates("DNSConfig=true, ProxyReadOnlyRootFS=false, Unknown=true, ShareProcessNamespace, ShareProcessNamespace=maybe")
+
+	want := map[string]bool{
+		featureDNSConfig:             true,
+		featureProxyReadOnlyRootFS:   false,
+		featureShareProcessNamespace: false,
+	}
+	for name, enabled := range want {
+		if got := featureEnabled(name); got != enabled {
+			t.Errorf("got feature gate %s %v, want %v", name, got, enabled)
+		}
+	}
+	if featureEnabled("Unknown") {
+		t.Error("unknown feature gate was enabled")
+	}
+}
+
+func TestFeatureGateOff(t *testing.T) {
+	defer withFeatureGates("")()
+
+	data := map[string]string{"dnsNameservers": "10.96.0.53", "dnsSearchDomains": "mesh"}
+	pod := injectTestPod(t, newPendingPod(defaultInitializerName), data)
+	if pod.Spec.DNSConfig != nil || pod.Spec.DNSPolicy != "" {
+		t.Errorf("got DNS policy %q and config %+v with the %s feature gate off", pod.Spec.DNSPolicy, pod.Spec.DNSConfig, featureDNSConfig)
+	}
+
+	setFeatureGates(featureDNSConfig + "=true")
+	pod = injectTestPod(t, newPendingPod(defaultInitializerName), data)
+	if pod.Spec.DNSConfig == nil {
+		t.Errorf("DNS config was not injected with the %s feature gate on", featureDNSConfig)
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+
+	"k8s.io/client-go/tools/cache"
+)
+
+// healthServer serves the liveness and readiness probes.
+type healthServer struct {
+	started   int32
+	hasSynced cache.InformerSynced
+}
+
+func newHealthServer(hasSynced cache.InformerSynced) *healthServer {
+	return &healthServer{hasSynced: hasSynced}
+}
+
+// setStarted marks the process as live.
+func (h *healthServer) setStarted() {
+	atomic.StoreInt32(&h.started, 1)
+}
+
+func (h *healthServer) healthz(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&h.started) == 0 {
+		http.Error(w, "not started", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+func (h *healthServer) readyz(w http.ResponseWriter, r *http.Request) {
+	if !h.hasSynced() {
+		http.Error(w, "informer not synced", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok"))
+}
+
+// serve serves /healthz and /readyz on addr.
+func (h *healthServer) serve(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", h.healthz)
+	mux.HandleFunc("/readyz", h.readyz)
+
+	log.Printf("Serving health checks on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
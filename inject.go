@@ -0,0 +1,842 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"k8s.io/apimachinery/pkg/util/intstr"
+)
+
+const (
+	bootstrapOverrideAnnotation       = "sidecar.istio.io/bootstrapOverride"
+	excludeInboundPortsAnnotation     = "traffic.sidecar.istio.io/excludeInboundPorts"
+	excludeOutboundPortsAnnotation    = "traffic.sidecar.istio.io/excludeOutboundPorts"
+	includeOutboundIPRangesAnnotation = "traffic.sidecar.istio.io/includeOutboundIPRanges"
+	interceptionModeAnnotation        = "sidecar.istio.io/interceptionMode"
+	statusAnnotation                  = "sidecar.istio.io/status"
+	proxyCPUAnnotation                = "sidecar.istio.io/proxyCPU"
+	proxyCPULimitAnnotation           = "sidecar.istio.io/proxyCPULimit"
+	proxyMemoryAnnotation             = "sidecar.istio.io/proxyMemory"
+	proxyMemoryLimitAnnotation        = "sidecar.istio.io/proxyMemoryLimit"
+
+	interceptionModeRedirect = "REDIRECT"
+
+	securityProfileAppArmor = "apparmor"
+	securityProfileSeccomp  = "seccomp"
+
+	bootstrapMountPath          = "/etc/istio/custom-bootstrap"
+	bootstrapTemplateFile       = "custom_bootstrap.json"
+	bootstrapVolumeName         = "custom-bootstrap-volume"
+	certMountPath               = "/etc/certs"
+	certVolumeName              = "istio-certs"
+	coreDumpMountPath           = "/var/lib/istio/core"
+	coreDumpVolumeName          = "istio-core"
+	enableCoreDumpContainerName = "enable-core-dump"
+	enableCoreDumpImage         = "alpine"
+	initContainerName           = "istio-init"
+	meshConfigMountPath         = "/etc/istio/config"
+	meshConfigVolumeName        = "istio-config"
+	podInfoMountPath            = "/etc/istio/pod"
+	podInfoVolumeName           = "istio-podinfo"
+	defaultProxyContainerName   = "istio-proxy"
+	proxyConfigPath             = "/etc/istio/proxy"
+	proxyConfigVolumeName       = "istio-envoy"
+	proxyPort                   = "15001"
+	proxyReadinessPath          = "/healthz/ready"
+	serviceCluster              = "istio-proxy"
+	tokenMountPath              = "/var/run/secrets/tokens"
+	tokenVolumeName             = "istio-token"
+
+	// terminationGraceBuffer is added to the proxy drain duration so the
+	// proxy is not killed as soon as the drain finishes.
+	terminationGraceBuffer = 5 * time.Second
+)
+
+// securityAnnotationPrefixes maps the kinds of the podAnnotationsForSecurity
+// configmap key to the per-container annotations they set.
+var securityAnnotationPrefixes = map[string]string{
+	securityProfileAppArmor: "container.apparmor.security.beta.kubernetes.io/",
+	securityProfileSeccomp:  "container.seccomp.security.alpha.kubernetes.io/",
+}
+
+// injectSidecar returns a copy of the pod with the sidecar injected. It does
+// not touch the pending initializers or the API server.
+func injectSidecar(pod *corev1.Pod, c *config) (*corev1.Pod, error) {
+	pod = pod.DeepCopy()
+
+	if alreadyInjected(pod, c) {
+		return pod, nil
+	}
+
+	containers, initContainers, err := sidecarContainers(pod, c)
+	if err != nil {
+		return nil, err
+	}
+
+	status := sidecarStatus{
+		Tag:     c.tag,
+		Version: c.version,
+		Volumes: []string{meshConfigVolumeName, certVolumeName, podInfoVolumeName},
+	}
+
+	for _, container := range containers {
+		status.Containers = append(status.Containers, container.Name)
+		if !hasContainer(pod.Spec.Containers, container.Name) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting container %s", container.Name)
+			pod.Spec.Containers = append(pod.Spec.Containers, container)
+		}
+	}
+
+	if !hasVolume(pod.Spec.Volumes, meshConfigVolumeName) {
+		V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", meshConfigVolumeName)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, meshConfigVolume(c))
+	}
+
+	if !hasVolume(pod.Spec.Volumes, certVolumeName) {
+		V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", certVolumeName)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, certVolume(c))
+	}
+
+	if !hasVolume(pod.Spec.Volumes, podInfoVolumeName) {
+		V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", podInfoVolumeName)
+		pod.Spec.Volumes = append(pod.Spec.Volumes, podInfoVolume())
+	}
+
+	if c.tokenAudience != "" {
+		status.Volumes = append(status.Volumes, tokenVolumeName)
+		if !hasVolume(pod.Spec.Volumes, tokenVolumeName) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", tokenVolumeName)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, tokenVolume(c))
+		}
+	}
+
+	if c.proxyReadOnlyRootFS {
+		status.Volumes = append(status.Volumes, proxyConfigVolumeName)
+		if !hasVolume(pod.Spec.Volumes, proxyConfigVolumeName) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", proxyConfigVolumeName)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, proxyConfigVolume())
+		}
+	}
+
+	if c.bootstrapConfigMap != "" {
+		status.Volumes = append(status.Volumes, bootstrapVolumeName)
+		if !hasVolume(pod.Spec.Volumes, bootstrapVolumeName) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", bootstrapVolumeName)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, bootstrapVolume(c))
+		}
+	}
+
+	for _, volume := range c.extraVolumes {
+		status.Volumes = append(status.Volumes, volume.Name)
+		if !hasVolume(pod.Spec.Volumes, volume.Name) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", volume.Name)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, volume)
+		}
+	}
+
+	// The iptables rules must be in place before any other init container runs.
+	for i := len(initContainers) - 1; i >= 0; i-- {
+		container := initContainers[i]
+		status.InitContainers = append([]string{container.Name}, status.InitContainers...)
+		if !hasContainer(pod.Spec.InitContainers, container.Name) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting init container %s", container.Name)
+			pod.Spec.InitContainers = append([]corev1.Container{container}, pod.Spec.InitContainers...)
+		}
+	}
+
+	if c.enableCoreDump {
+		status.InitContainers = append(status.InitContainers, enableCoreDumpContainerName)
+		if !hasContainer(pod.Spec.InitContainers, enableCoreDumpContainerName) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting init container %s", enableCoreDumpContainerName)
+			pod.Spec.InitContainers = append(pod.Spec.InitContainers, enableCoreDumpContainer())
+		}
+
+		status.Volumes = append(status.Volumes, coreDumpVolumeName)
+		if !hasVolume(pod.Spec.Volumes, coreDumpVolumeName) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting volume %s", coreDumpVolumeName)
+			pod.Spec.Volumes = append(pod.Spec.Volumes, coreDumpVolume())
+		}
+
+		if c.shareProcessNamespace {
+			shareProcessNamespace := true
+			pod.Spec.ShareProcessNamespace = &shareProcessNamespace
+		}
+	}
+
+	for _, name := range c.imagePullSecrets {
+		if !hasImagePullSecret(pod.Spec.ImagePullSecrets, name) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting image pull secret %s", name)
+			pod.Spec.ImagePullSecrets = append(pod.Spec.ImagePullSecrets, corev1.LocalObjectReference{Name: name})
+		}
+	}
+
+	raiseTerminationGracePeriod(pod, c)
+
+	if len(c.dnsNameservers) > 0 || len(c.dnsSearchDomains) > 0 {
+		injectDNSConfig(pod, c)
+	}
+
+	// Keys already set on the pod are left untouched.
+	if len(c.injectedLabels) > 0 && pod.ObjectMeta.Labels == nil {
+		pod.ObjectMeta.Labels = make(map[string]string)
+	}
+
+	for key, value := range c.injectedLabels {
+		if _, ok := pod.ObjectMeta.Labels[key]; !ok {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting label %s", key)
+			pod.ObjectMeta.Labels[key] = value
+		}
+	}
+
+	if pod.ObjectMeta.Annotations == nil {
+		pod.ObjectMeta.Annotations = make(map[string]string)
+	}
+
+	// Hardened nodes only admit the proxy with the matching security profiles.
+	for kind, profile := range c.podAnnotationsForSecurity {
+		key := securityAnnotationPrefixes[kind] + c.proxyContainerName
+		if _, ok := pod.ObjectMeta.Annotations[key]; !ok {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting annotation %s", key)
+			pod.ObjectMeta.Annotations[key] = profile
+		}
+	}
+
+	// The CNI plugin reads the interception mode to set up the redirection.
+	if c.cniEnabled {
+		if _, ok := pod.ObjectMeta.Annotations[interceptionModeAnnotation]; !ok {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting annotation %s", interceptionModeAnnotation)
+			pod.ObjectMeta.Annotations[interceptionModeAnnotation] = interceptionModeRedirect
+		}
+	}
+
+	for key, value := range c.injectedAnnotations {
+		if _, ok := pod.ObjectMeta.Annotations[key]; !ok {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting annotation %s", key)
+			pod.ObjectMeta.Annotations[key] = value
+		}
+	}
+
+	out, err := json.Marshal(status)
+	if err != nil {
+		return nil, err
+	}
+	pod.ObjectMeta.Annotations[statusAnnotation] = string(out)
+
+	return pod, nil
+}
+
+// raiseTerminationGracePeriod makes sure the pod's termination grace period
+// covers the proxy drain duration and minTerminationGracePeriod. Longer grace
+// periods are left untouched.
+func raiseTerminationGracePeriod(pod *corev1.Pod, c *config) {
+	var required time.Duration
+	if c.proxyDrainDuration > 0 {
+		required = c.proxyDrainDuration + terminationGraceBuffer
+	}
+	if c.minTerminationGracePeriod > required {
+		required = c.minTerminationGracePeriod
+	}
+	if required == 0 {
+		return
+	}
+
+	current := int64(corev1.DefaultTerminationGracePeriodSeconds)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		current = *pod.Spec.TerminationGracePeriodSeconds
+	}
+
+	seconds := int64(math.Ceil(required.Seconds()))
+	if current < seconds {
+		V(4).PodPrintf(pod.Namespace, pod.Name, nil, "raising termination grace period to %ds", seconds)
+		pod.Spec.TerminationGracePeriodSeconds = &seconds
+	}
+}
+
+// injectDNSConfig points the pod at the mesh DNS, appending to any DNS config
+// the pod already has.
+func injectDNSConfig(pod *corev1.Pod, c *config) {
+	if pod.Spec.DNSConfig == nil {
+		pod.Spec.DNSConfig = &corev1.PodDNSConfig{}
+	}
+
+	for _, nameserver := range c.dnsNameservers {
+		if !containsString(pod.Spec.DNSConfig.Nameservers, nameserver) {
+			pod.Spec.DNSConfig.Nameservers = append(pod.Spec.DNSConfig.Nameservers, nameserver)
+		}
+	}
+
+	for _, search := range c.dnsSearchDomains {
+		if !containsString(pod.Spec.DNSConfig.Searches, search) {
+			pod.Spec.DNSConfig.Searches = append(pod.Spec.DNSConfig.Searches, search)
+		}
+	}
+
+	V(4).PodPrintf(pod.Namespace, pod.Name, nil, "injecting dns config")
+	pod.Spec.DNSPolicy = corev1.DNSNone
+}
+
+// sidecarStatus is recorded in the status annotation of injected pods. The
+// fields are kept in alphabetical order so the JSON is stable.
+type sidecarStatus struct {
+	Containers     []string `json:"containers"`
+	InitContainers []string `json:"initContainers"`
+	Tag            string   `json:"tag"`
+	Version        string   `json:"version"`
+	Volumes        []string `json:"volumes"`
+}
+
+// alreadyInjected reports whether the sidecar has already been injected into
+// the pod, so that re-processing a pod never adds a second proxy. A status
+// annotation recording other containers, written by an injector using another
+// proxy container name, does not count.
+func alreadyInjected(pod *corev1.Pod, c *config) bool {
+	if hasContainer(pod.Spec.Containers, c.proxyContainerName) {
+		return true
+	}
+
+	value, ok := pod.ObjectMeta.Annotations[statusAnnotation]
+	if !ok {
+		return false
+	}
+
+	var status sidecarStatus
+	if err := json.Unmarshal([]byte(value), &status); err != nil {
+		return true
+	}
+	return containsString(status.Containers, c.proxyContainerName)
+}
+
+// sidecarContainers returns the containers and init containers to inject,
+// rendered from the configured template or built from the config when no
+// template is set.
+func sidecarContainers(pod *corev1.Pod, c *config) ([]corev1.Container, []corev1.Container, error) {
+	var containers, initContainers []corev1.Container
+	if c.sidecarTemplate == nil {
+		containers = []corev1.Container{proxyContainer(pod, c)}
+		initContainers = []corev1.Container{initContainer(pod, c)}
+	} else {
+		spec, err := renderSidecarTemplate(c.sidecarTemplate, pod, c)
+		if err != nil {
+			return nil, nil, err
+		}
+		containers, initContainers = spec.Containers, spec.InitContainers
+	}
+
+	// With the CNI plugin the redirection is set up when the pod network is
+	// created, so the privileged iptables init container is not needed.
+	if c.cniEnabled {
+		var filtered []corev1.Container
+		for _, container := range initContainers {
+			if container.Name != initContainerName {
+				filtered = append(filtered, container)
+			}
+		}
+		initContainers = filtered
+	}
+	return containers, initContainers, nil
+}
+
+func proxyContainer(pod *corev1.Pod, c *config) corev1.Container {
+	uid := c.sidecarProxyUID
+	cpuRequest, cpuLimit := annotationRequirement(pod, corev1.ResourceCPU,
+		proxyCPUAnnotation, proxyCPULimitAnnotation, c.proxyCPURequest, c.proxyCPULimit)
+	memoryRequest, memoryLimit := annotationRequirement(pod, corev1.ResourceMemory,
+		proxyMemoryAnnotation, proxyMemoryLimitAnnotation, c.proxyMemoryRequest, c.proxyMemoryLimit)
+
+	container := corev1.Container{
+		Name:            c.proxyContainerName,
+		Image:           c.proxyImage(),
+		ImagePullPolicy: c.imagePullPolicy,
+		Args: []string{
+			"proxy",
+			"sidecar",
+			"-v", strconv.Itoa(c.verbosity),
+			"--configPath", proxyConfigPath,
+			"--serviceCluster", serviceClusterName(pod, c),
+			"--meshConfig", meshConfigMountPath + "/mesh",
+		},
+		// The downward API variables win over the configured ones.
+		Env: appendEnv(appendEnv(nil,
+			fieldRefEnv("POD_NAME", "metadata.name"),
+			fieldRefEnv("POD_NAMESPACE", "metadata.namespace"),
+			fieldRefEnv("INSTANCE_IP", "status.podIP"),
+		), c.proxyEnv...),
+		Ports: []corev1.ContainerPort{
+			{
+				Name:          "status",
+				ContainerPort: int32(c.statusPort),
+			},
+		},
+		ReadinessProbe: &corev1.Probe{
+			Handler: corev1.Handler{
+				HTTPGet: &corev1.HTTPGetAction{
+					Path: proxyReadinessPath,
+					Port: intstr.FromInt(c.statusPort),
+				},
+			},
+			InitialDelaySeconds: c.readinessInitialDelaySeconds,
+			PeriodSeconds:       c.readinessPeriodSeconds,
+		},
+		Resources: resourceRequirements(cpuRequest, memoryRequest, cpuLimit, memoryLimit),
+		SecurityContext: &corev1.SecurityContext{
+			RunAsUser: &uid,
+		},
+		VolumeMounts: []corev1.VolumeMount{
+			{
+				Name:      meshConfigVolumeName,
+				MountPath: meshConfigMountPath,
+				ReadOnly:  true,
+			},
+			{
+				Name:      certVolumeName,
+				MountPath: certMountPath,
+				ReadOnly:  true,
+			},
+			{
+				Name:      podInfoVolumeName,
+				MountPath: podInfoMountPath,
+				ReadOnly:  true,
+			},
+		},
+	}
+
+	// Give in-flight requests time to drain before the proxy is stopped.
+	if c.proxyDrainDuration > 0 {
+		container.Lifecycle = &corev1.Lifecycle{
+			PreStop: &corev1.Handler{
+				Exec: &corev1.ExecAction{
+					Command: []string{"/bin/sh", "-c", fmt.Sprintf("sleep %d", int64(c.proxyDrainDuration.Seconds()))},
+				},
+			},
+		}
+	}
+
+	if c.bootstrapConfigMap != "" {
+		container.Args = append(container.Args, "--templateFile", bootstrapMountPath+"/"+bootstrapTemplateFile)
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      bootstrapVolumeName,
+			MountPath: bootstrapMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if concurrency := proxyConcurrency(cpuLimit, c); concurrency > 0 {
+		container.Args = append(container.Args, "--concurrency", strconv.Itoa(concurrency))
+	}
+
+	if c.proxyRunAsNonRoot {
+		runAsNonRoot := true
+		container.SecurityContext.RunAsNonRoot = &runAsNonRoot
+	}
+
+	if c.tokenAudience != "" {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      tokenVolumeName,
+			MountPath: tokenMountPath,
+			ReadOnly:  true,
+		})
+	}
+
+	if c.enableCoreDump {
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      coreDumpVolumeName,
+			MountPath: coreDumpMountPath,
+		})
+	}
+
+	// With a read-only root filesystem the proxy writes its generated config
+	// to a scratch volume.
+	if c.proxyReadOnlyRootFS {
+		readOnlyRootFS := true
+		container.SecurityContext.ReadOnlyRootFilesystem = &readOnlyRootFS
+		container.VolumeMounts = append(container.VolumeMounts, corev1.VolumeMount{
+			Name:      proxyConfigVolumeName,
+			MountPath: proxyConfigPath,
+		})
+	}
+
+	for _, mount := range c.extraVolumeMounts {
+		if !hasVolumeMount(container.VolumeMounts, mount.Name) {
+			container.VolumeMounts = append(container.VolumeMounts, mount)
+		}
+	}
+
+	return container
+}
+
+func bootstrapVolume(c *config) corev1.Volume {
+	return corev1.Volume{
+		Name: bootstrapVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: c.bootstrapConfigMap,
+				},
+			},
+		},
+	}
+}
+
+func meshConfigVolume(c *config) corev1.Volume {
+	return corev1.Volume{
+		Name: meshConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{
+					Name: c.meshConfig,
+				},
+			},
+		},
+	}
+}
+
+// resourceRequirements builds the resource requirements of an injected
+// container, omitting any request or limit that is nil.
+func resourceRequirements(cpuRequest, memoryRequest, cpuLimit, memoryLimit *resource.Quantity) corev1.ResourceRequirements {
+	var requirements corev1.ResourceRequirements
+
+	requests := corev1.ResourceList{}
+	if cpuRequest != nil {
+		requests[corev1.ResourceCPU] = *cpuRequest
+	}
+	if memoryRequest != nil {
+		requests[corev1.ResourceMemory] = *memoryRequest
+	}
+	if len(requests) > 0 {
+		requirements.Requests = requests
+	}
+
+	limits := corev1.ResourceList{}
+	if cpuLimit != nil {
+		limits[corev1.ResourceCPU] = *cpuLimit
+	}
+	if memoryLimit != nil {
+		limits[corev1.ResourceMemory] = *memoryLimit
+	}
+	if len(limits) > 0 {
+		requirements.Limits = limits
+	}
+
+	return requirements
+}
+
+// serviceClusterName returns the service cluster the proxy registers as: the
+// value of the serviceClusterLabel pod label, falling back to the name of the
+// pod's first owner and then to the pod name.
+func serviceClusterName(pod *corev1.Pod, c *config) string {
+	if name := pod.ObjectMeta.Labels[c.serviceClusterLabel]; name != "" {
+		return name
+	}
+	if len(pod.ObjectMeta.OwnerReferences) > 0 && pod.ObjectMeta.OwnerReferences[0].Name != "" {
+		return pod.ObjectMeta.OwnerReferences[0].Name
+	}
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return serviceCluster
+}
+
+// proxyConcurrency returns the number of proxy worker threads: the configured
+// concurrency, else the CPU limit rounded up to whole cores, else 0 to leave
+// the proxy default.
+func proxyConcurrency(cpuLimit *resource.Quantity, c *config) int {
+	if c.concurrency > 0 {
+		return c.concurrency
+	}
+	if cpuLimit == nil || cpuLimit.IsZero() {
+		return 0
+	}
+	return int((cpuLimit.MilliValue() + 999) / 1000)
+}
+
+// annotationQuantity returns the quantity set by the pod annotation, falling
+// back to the configured quantity when the annotation is missing or invalid.
+func annotationQuantity(pod *corev1.Pod, annotation string, fallback *resource.Quantity) *resource.Quantity {
+	value, ok := pod.ObjectMeta.GetAnnotations()[annotation]
+	if !ok {
+		return fallback
+	}
+
+	q, err := resource.ParseQuantity(value)
+	if err != nil {
+		V(0).PodPrintf(pod.Namespace, pod.Name, err, "warning: ignoring invalid %s annotation %q", annotation, value)
+		return fallback
+	}
+	return &q
+}
+
+// annotationRequirement returns the request and limit of the resource set by
+// the pod annotations, falling back to the configured ones. Overrides leaving
+// the request above the limit would fail the pod update, so they are ignored.
+func annotationRequirement(pod *corev1.Pod, name corev1.ResourceName, requestAnnotation, limitAnnotation string, request, limit *resource.Quantity) (*resource.Quantity, *resource.Quantity) {
+	overriddenRequest := annotationQuantity(pod, requestAnnotation, request)
+	overriddenLimit := annotationQuantity(pod, limitAnnotation, limit)
+	if overriddenRequest == request && overriddenLimit == limit {
+		return request, limit
+	}
+
+	if overriddenRequest != nil && overriddenLimit != nil && overriddenRequest.Cmp(*overriddenLimit) > 0 {
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: ignoring the %s and %s annotations, %s request %s exceeds limit %s",
+			requestAnnotation, limitAnnotation, name, overriddenRequest.String(), overriddenLimit.String())
+		return request, limit
+	}
+	return overriddenRequest, overriddenLimit
+}
+
+func initContainer(pod *corev1.Pod, c *config) corev1.Container {
+	args := []string{
+		"-p", proxyPort,
+		"-u", strconv.FormatInt(c.sidecarProxyUID, 10),
+		"-i", includeIPRanges(pod, c),
+	}
+
+	excludeInboundPorts := append([]string(nil), c.excludeInboundPorts...)
+	if value, ok := pod.ObjectMeta.GetAnnotations()[excludeInboundPortsAnnotation]; ok {
+		excludeInboundPorts = parseList(value)
+	}
+
+	// The status port serves the readiness probe, which must reach the proxy
+	// directly.
+	statusPort := strconv.Itoa(c.statusPort)
+	if !containsString(excludeInboundPorts, statusPort) {
+		excludeInboundPorts = append(excludeInboundPorts, statusPort)
+	}
+	args = append(args, "-d", strings.Join(excludeInboundPorts, ","))
+
+	if ports := excludeOutboundPorts(pod, c); len(ports) > 0 {
+		args = append(args, "-o", strings.Join(ports, ","))
+	}
+
+	return corev1.Container{
+		Name:            initContainerName,
+		Image:           c.proxyInitImage(),
+		ImagePullPolicy: c.imagePullPolicy,
+		Args:            args,
+		Resources:       resourceRequirements(c.initCPURequest, c.initMemoryRequest, c.initCPULimit, c.initMemoryLimit),
+		SecurityContext: &corev1.SecurityContext{
+			Capabilities: &corev1.Capabilities{
+				Add: []corev1.Capability{"NET_ADMIN"},
+			},
+		},
+	}
+}
+
+// excludeOutboundPorts returns the outbound ports that bypass the proxy. The
+// pod annotation replaces the config, or is added to it when
+// excludeOutboundPortsMode is merge.
+func excludeOutboundPorts(pod *corev1.Pod, c *config) []string {
+	value, ok := pod.ObjectMeta.GetAnnotations()[excludeOutboundPortsAnnotation]
+	if !ok {
+		return c.excludeOutboundPorts
+	}
+
+	if c.excludeOutboundPortsMode != excludePortsMerge {
+		return parseList(value)
+	}
+
+	ports := append([]string(nil), c.excludeOutboundPorts...)
+	for _, port := range parseList(value) {
+		if !containsString(ports, port) {
+			ports = append(ports, port)
+		}
+	}
+	return ports
+}
+
+// includeIPRanges returns the outbound IP ranges redirected to the proxy. The
+// pod annotation overrides the config, and an empty annotation captures no
+// outbound traffic. An empty config value captures all outbound traffic.
+func includeIPRanges(pod *corev1.Pod, c *config) string {
+	if value, ok := pod.ObjectMeta.GetAnnotations()[includeOutboundIPRangesAnnotation]; ok {
+		return value
+	}
+
+	if c.includeIPRanges == "" {
+		return "*"
+	}
+	return c.includeIPRanges
+}
+
+func enableCoreDumpContainer() corev1.Container {
+	privileged := true
+
+	return corev1.Container{
+		Name:    enableCoreDumpContainerName,
+		Image:   enableCoreDumpImage,
+		Command: []string{"/bin/sh"},
+		Args: []string{
+			"-c",
+			fmt.Sprintf("sysctl -w kernel.core_pattern=%s/core.%%e.%%p.%%t && ulimit -c unlimited", coreDumpMountPath),
+		},
+		SecurityContext: &corev1.SecurityContext{
+			Privileged: &privileged,
+		},
+	}
+}
+
+// coreDumpVolume holds the proxy core dumps when enableCoreDump is set.
+func coreDumpVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: coreDumpVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{},
+		},
+	}
+}
+
+// certVolume is optional so that pods still start when the certificate secret
+// has not been created in their namespace yet.
+func certVolume(c *config) corev1.Volume {
+	optional := true
+
+	return corev1.Volume{
+		Name: certVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Secret: &corev1.SecretVolumeSource{
+				SecretName: c.caCertSecret,
+				Optional:   &optional,
+			},
+		},
+	}
+}
+
+// podInfoVolume exposes the pod metadata to the proxy through the downward API.
+func podInfoVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: podInfoVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			DownwardAPI: &corev1.DownwardAPIVolumeSource{
+				Items: []corev1.DownwardAPIVolumeFile{
+					{Path: "name", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.name"}},
+					{Path: "namespace", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.namespace"}},
+					{Path: "labels", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.labels"}},
+					{Path: "annotations", FieldRef: &corev1.ObjectFieldSelector{FieldPath: "metadata.annotations"}},
+				},
+			},
+		},
+	}
+}
+
+// tokenVolume projects a service account token for the proxy identity, with
+// the configured audience.
+func tokenVolume(c *config) corev1.Volume {
+	expirationSeconds := c.tokenExpirationSeconds
+
+	return corev1.Volume{
+		Name: tokenVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			Projected: &corev1.ProjectedVolumeSource{
+				Sources: []corev1.VolumeProjection{
+					{
+						ServiceAccountToken: &corev1.ServiceAccountTokenProjection{
+							Audience:          c.tokenAudience,
+							ExpirationSeconds: &expirationSeconds,
+							Path:              tokenVolumeName,
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+// proxyConfigVolume is the scratch space the proxy writes its config to when
+// its root filesystem is read-only.
+func proxyConfigVolume() corev1.Volume {
+	return corev1.Volume{
+		Name: proxyConfigVolumeName,
+		VolumeSource: corev1.VolumeSource{
+			EmptyDir: &corev1.EmptyDirVolumeSource{Medium: corev1.StorageMediumMemory},
+		},
+	}
+}
+
+func fieldRefEnv(name, fieldPath string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			FieldRef: &corev1.ObjectFieldSelector{FieldPath: fieldPath},
+		},
+	}
+}
+
+// appendEnv appends the environment variables that are not already set.
+func appendEnv(env []corev1.EnvVar, vars ...corev1.EnvVar) []corev1.EnvVar {
+	for _, v := range vars {
+		if !hasEnv(env, v.Name) {
+			env = append(env, v)
+		}
+	}
+	return env
+}
+
+func hasEnv(env []corev1.EnvVar, name string) bool {
+	for _, v := range env {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func hasContainer(containers []corev1.Container, name string) bool {
+	for _, container := range containers {
+		if container.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasImagePullSecret(secrets []corev1.LocalObjectReference, name string) bool {
+	for _, secret := range secrets {
+		if secret.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, volume := range volumes {
+		if volume.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func hasVolumeMount(mounts []corev1.VolumeMount, name string) bool {
+	for _, mount := range mounts {
+		if mount.Name == name {
+			return true
+		}
+	}
+	return false
+}
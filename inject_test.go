@@ -0,0 +1,1118 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// injectTestPod returns the pod injected with the config built from data.
+func injectTestPod(t *testing.T, pod *corev1.Pod, data map[string]string) *corev1.Pod {
+	t.Helper()
+
+	injected, err := injectSidecar(pod, newTestConfig(t, data))
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+	return injected
+}
+
+func findContainer(containers []corev1.Container, name string) *corev1.Container {
+	for i := range containers {
+		if containers[i].Name == name {
+			return &containers[i]
+		}
+	}
+	return nil
+}
+
+func findVolume(volumes []corev1.Volume, name string) *corev1.Volume {
+	for i := range volumes {
+		if volumes[i].Name == name {
+			return &volumes[i]
+		}
+	}
+	return nil
+}
+
+func TestEnableCoreDump(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("enableCoreDump=%v", enabled), func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+				"enableCoreDump": fmt.Sprint(enabled),
+			})
+
+			container := findContainer(pod.Spec.InitContainers, enableCoreDumpContainerName)
+			if !enabled {
+				if container != nil {
+					t.Errorf("init container %s was injected", enableCoreDumpContainerName)
+				}
+				return
+			}
+
+			if container == nil {
+				t.Fatalf("init container %s was not injected", enableCoreDumpContainerName)
+			}
+			if sc := container.SecurityContext; sc == nil || sc.Privileged == nil || !*sc.Privileged {
+				t.Errorf("init container %s is not privileged", enableCoreDumpContainerName)
+			}
+			if !strings.Contains(strings.Join(container.Args, " "), "sysctl -w kernel.core_pattern=") {
+				t.Errorf("init container %s does not set the core pattern, got args %v", enableCoreDumpContainerName, container.Args)
+			}
+		})
+	}
+}
+
+func TestProxyResources(t *testing.T) {
+	data := map[string]string{
+		"proxyCPURequest":    "100m",
+		"proxyCPULimit":      "1",
+		"proxyMemoryRequest": "128Mi",
+		"proxyMemoryLimit":   "1Gi",
+	}
+
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		want        map[corev1.ResourceName]string
+		wantLimits  map[corev1.ResourceName]string
+	}{
+		{
+			name:       "configmap defaults",
+			want:       map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "128Mi"},
+			wantLimits: map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "1Gi"},
+		},
+		{
+			name: "annotation overrides",
+			annotations: map[string]string{
+				proxyCPUAnnotation:         "200m",
+				proxyCPULimitAnnotation:    "2",
+				proxyMemoryAnnotation:      "256Mi",
+				proxyMemoryLimitAnnotation: "2Gi",
+			},
+			want:       map[corev1.ResourceName]string{corev1.ResourceCPU: "200m", corev1.ResourceMemory: "256Mi"},
+			wantLimits: map[corev1.ResourceName]string{corev1.ResourceCPU: "2", corev1.ResourceMemory: "2Gi"},
+		},
+		{
+			name: "malformed annotations",
+			annotations: map[string]string{
+				proxyCPUAnnotation:         "lots",
+				proxyMemoryLimitAnnotation: "1 gig",
+			},
+			want:       map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "128Mi"},
+			wantLimits: map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "1Gi"},
+		},
+		{
+			name:        "request above the configmap limit",
+			annotations: map[string]string{proxyMemoryAnnotation: "2Gi"},
+			want:        map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "128Mi"},
+			wantLimits:  map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "1Gi"},
+		},
+		{
+			name:        "limit below the configmap request",
+			annotations: map[string]string{proxyCPULimitAnnotation: "50m"},
+			want:        map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "128Mi"},
+			wantLimits:  map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "1Gi"},
+		},
+		{
+			name: "request and limit raised together",
+			annotations: map[string]string{
+				proxyMemoryAnnotation:      "2Gi",
+				proxyMemoryLimitAnnotation: "4Gi",
+			},
+			want:       map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "2Gi"},
+			wantLimits: map[corev1.ResourceName]string{corev1.ResourceCPU: "1", corev1.ResourceMemory: "4Gi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Annotations = tt.annotations
+
+			resources := proxyContainer(pod, newTestConfig(t, data)).Resources
+			checkResources(t, "request", resources.Requests, tt.want)
+			checkResources(t, "limit", resources.Limits, tt.wantLimits)
+		})
+	}
+}
+
+func checkResources(t *testing.T, kind string, got corev1.ResourceList, want map[corev1.ResourceName]string) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("got %d %ss, want %d", len(got), kind, len(want))
+	}
+	for name, value := range want {
+		q, ok := got[name]
+		if !ok {
+			t.Errorf("missing %s %s", name, kind)
+			continue
+		}
+		if q.String() != value {
+			t.Errorf("got %s %s %s, want %s", name, kind, q.String(), value)
+		}
+	}
+}
+
+func TestImagePullSecrets(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	pod.Spec.ImagePullSecrets = []corev1.LocalObjectReference{{Name: "app-registry"}, {Name: "istio-registry"}}
+
+	pod = injectTestPod(t, pod, map[string]string{"imagePullSecrets": "istio-registry, mirror-registry"})
+
+	var got []string
+	for _, secret := range pod.Spec.ImagePullSecrets {
+		got = append(got, secret.Name)
+	}
+	want := []string{"app-registry", "istio-registry", "mirror-registry"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got image pull secrets %v, want %v", got, want)
+	}
+}
+
+func TestDownwardAPI(t *testing.T) {
+	// The configured POD_NAME must not shadow the downward API one.
+	pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+		"proxyEnv": "POD_NAME=static,ISTIO_META_MODE=test",
+	})
+
+	proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+	if proxy == nil {
+		t.Fatalf("container %s was not injected", defaultProxyContainerName)
+	}
+
+	fieldPaths := map[string]string{
+		"POD_NAME":      "metadata.name",
+		"POD_NAMESPACE": "metadata.namespace",
+		"INSTANCE_IP":   "status.podIP",
+	}
+	seen := make(map[string]int)
+	for _, env := range proxy.Env {
+		seen[env.Name]++
+		want, ok := fieldPaths[env.Name]
+		if !ok {
+			continue
+		}
+		if env.ValueFrom == nil || env.ValueFrom.FieldRef == nil || env.ValueFrom.FieldRef.FieldPath != want {
+			t.Errorf("env %s is not a field reference to %s", env.Name, want)
+		}
+	}
+	for name := range fieldPaths {
+		if seen[name] != 1 {
+			t.Errorf("got env %s %d times, want once", name, seen[name])
+		}
+	}
+	if seen["ISTIO_META_MODE"] != 1 {
+		t.Error("configured env ISTIO_META_MODE is missing")
+	}
+
+	var volume *corev1.Volume
+	for i := range pod.Spec.Volumes {
+		if pod.Spec.Volumes[i].Name == podInfoVolumeName {
+			volume = &pod.Spec.Volumes[i]
+		}
+	}
+	if volume == nil || volume.DownwardAPI == nil {
+		t.Fatalf("downward API volume %s was not injected", podInfoVolumeName)
+	}
+
+	var got []string
+	for _, item := range volume.DownwardAPI.Items {
+		got = append(got, item.FieldRef.FieldPath)
+	}
+	want := []string{"metadata.name", "metadata.namespace", "metadata.labels", "metadata.annotations"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got downward API fields %v, want %v", got, want)
+	}
+
+	mounted := false
+	for _, mount := range proxy.VolumeMounts {
+		if mount.Name == podInfoVolumeName && mount.MountPath == podInfoMountPath {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("volume %s is not mounted at %s", podInfoVolumeName, podInfoMountPath)
+	}
+}
+
+// containerArg returns the value of the container flag.
+func containerArg(t *testing.T, container corev1.Container, flag string) string {
+	t.Helper()
+
+	for i, arg := range container.Args {
+		if arg == flag && i+1 < len(container.Args) {
+			return container.Args[i+1]
+		}
+	}
+	t.Fatalf("container args %v have no %s", container.Args, flag)
+	return ""
+}
+
+func TestIncludeIPRanges(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		data        map[string]string
+		want        string
+	}{
+		{
+			name: "missing annotation",
+			data: map[string]string{"includeIPRanges": "10.0.0.0/8"},
+			want: "10.0.0.0/8",
+		},
+		{
+			name: "missing annotation and config",
+			want: "*",
+		},
+		{
+			name:        "empty annotation",
+			annotations: map[string]string{includeOutboundIPRangesAnnotation: ""},
+			data:        map[string]string{"includeIPRanges": "10.0.0.0/8"},
+			want:        "",
+		},
+		{
+			name:        "CIDR annotation",
+			annotations: map[string]string{includeOutboundIPRangesAnnotation: "172.16.0.0/12,192.168.0.0/16"},
+			data:        map[string]string{"includeIPRanges": "10.0.0.0/8"},
+			want:        "172.16.0.0/12,192.168.0.0/16",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Annotations = tt.annotations
+
+			if got := containerArg(t, initContainer(pod, newTestConfig(t, tt.data)), "-i"); got != tt.want {
+				t.Errorf("got -i %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectSidecarTwice(t *testing.T) {
+	c := newTestConfig(t, nil)
+
+	once, err := injectSidecar(newPendingPod(defaultInitializerName), c)
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+	twice, err := injectSidecar(once, c)
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+
+	count := 0
+	for _, container := range twice.Spec.Containers {
+		if container.Name == defaultProxyContainerName {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("got %d %s containers, want 1", count, defaultProxyContainerName)
+	}
+	if !reflect.DeepEqual(twice, once) {
+		t.Error("injecting an injected pod modified it")
+	}
+}
+
+func TestStatusAnnotation(t *testing.T) {
+	pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+		"tag":     "1.0",
+		"version": "abc123",
+	})
+
+	want := `{"containers":["istio-proxy"],"initContainers":["istio-init"],"tag":"1.0","version":"abc123","volumes":["istio-config","istio-certs","istio-podinfo","istio-token"]}`
+	if got := pod.Annotations[statusAnnotation]; got != want {
+		t.Errorf("got %s annotation\n%s\nwant\n%s", statusAnnotation, got, want)
+	}
+}
+
+func TestProxyEnv(t *testing.T) {
+	c := newTestConfig(t, map[string]string{
+		"proxyEnv": "ISTIO_META_A=1, =missing-key, MISSING_VALUE, INSTANCE_IP=10.0.0.1, ISTIO_META_B=x=y",
+	})
+
+	var got []string
+	for _, env := range proxyContainer(newPendingPod(), c).Env {
+		if env.ValueFrom != nil {
+			got = append(got, env.Name+" from "+env.ValueFrom.FieldRef.FieldPath)
+			continue
+		}
+		got = append(got, env.Name+"="+env.Value)
+	}
+
+	// The downward API variables win over the configured ones, malformed
+	// pairs are skipped.
+	want := []string{
+		"POD_NAME from metadata.name",
+		"POD_NAMESPACE from metadata.namespace",
+		"INSTANCE_IP from status.podIP",
+		"ISTIO_META_A=1",
+		"ISTIO_META_B=x=y",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got env %v, want %v", got, want)
+	}
+}
+
+func TestServiceClusterName(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   map[string]string
+		labels map[string]string
+		owners []metav1.OwnerReference
+		pod    string
+		want   string
+	}{
+		{
+			name:   "app label",
+			labels: map[string]string{"app": "reviews"},
+			owners: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "reviews-v1-5d8f"}},
+			pod:    "reviews-v1-5d8f-x7k2p",
+			want:   "reviews",
+		},
+		{
+			name:   "configured label",
+			data:   map[string]string{"serviceClusterLabel": "service"},
+			labels: map[string]string{"app": "reviews", "service": "ratings"},
+			pod:    "reviews-v1-5d8f-x7k2p",
+			want:   "ratings",
+		},
+		{
+			name:   "first owner",
+			labels: map[string]string{"version": "v1"},
+			owners: []metav1.OwnerReference{{Kind: "ReplicaSet", Name: "reviews-v1-5d8f"}, {Kind: "Job", Name: "other"}},
+			pod:    "reviews-v1-5d8f-x7k2p",
+			want:   "reviews-v1-5d8f",
+		},
+		{
+			name: "pod name",
+			pod:  "reviews",
+			want: "reviews",
+		},
+		{
+			name: "nothing to go by",
+			want: serviceCluster,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod()
+			pod.Name = tt.pod
+			pod.Labels = tt.labels
+			pod.OwnerReferences = tt.owners
+
+			container := proxyContainer(pod, newTestConfig(t, tt.data))
+			if got := containerArg(t, container, "--serviceCluster"); got != tt.want {
+				t.Errorf("got --serviceCluster %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestImagePullPolicy(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want corev1.PullPolicy
+	}{
+		{
+			name: "default",
+			want: corev1.PullIfNotPresent,
+		},
+		{
+			name: "always",
+			data: map[string]string{"imagePullPolicy": "Always"},
+			want: corev1.PullAlways,
+		},
+		{
+			name: "never",
+			data: map[string]string{"imagePullPolicy": "Never"},
+			want: corev1.PullNever,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), tt.data)
+
+			for _, container := range []*corev1.Container{
+				findContainer(pod.Spec.Containers, defaultProxyContainerName),
+				findContainer(pod.Spec.InitContainers, initContainerName),
+			} {
+				if container == nil {
+					t.Fatal("sidecar container was not injected")
+				}
+				if container.ImagePullPolicy != tt.want {
+					t.Errorf("got %s pull policy %s, want %s", container.Name, container.ImagePullPolicy, tt.want)
+				}
+			}
+		})
+	}
+
+	if err := newTestConfig(t, map[string]string{"imagePullPolicy": "Sometimes"}).validate(); err == nil {
+		t.Error("got no error for an invalid imagePullPolicy")
+	}
+}
+
+func TestProxySecurityContext(t *testing.T) {
+	defer withFeatureGates(featureProxyReadOnlyRootFS + "=true")()
+
+	tests := []struct {
+		name             string
+		data             map[string]string
+		wantReadOnly     bool
+		wantRunAsNonRoot bool
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:         "read-only root filesystem",
+			data:         map[string]string{"proxyReadOnlyRootFS": "true"},
+			wantReadOnly: true,
+		},
+		{
+			name:             "run as non-root",
+			data:             map[string]string{"proxyRunAsNonRoot": "true"},
+			wantRunAsNonRoot: true,
+		},
+		{
+			name:             "both",
+			data:             map[string]string{"proxyReadOnlyRootFS": "true", "proxyRunAsNonRoot": "true"},
+			wantReadOnly:     true,
+			wantRunAsNonRoot: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), tt.data)
+			proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+			if proxy == nil {
+				t.Fatalf("container %s was not injected", defaultProxyContainerName)
+			}
+
+			sc := proxy.SecurityContext
+			if sc == nil || sc.RunAsUser == nil || *sc.RunAsUser != 1337 {
+				t.Fatalf("got security context %+v, want RunAsUser 1337", sc)
+			}
+			if got := sc.ReadOnlyRootFilesystem != nil && *sc.ReadOnlyRootFilesystem; got != tt.wantReadOnly {
+				t.Errorf("got ReadOnlyRootFilesystem %v, want %v", got, tt.wantReadOnly)
+			}
+			if got := sc.RunAsNonRoot != nil && *sc.RunAsNonRoot; got != tt.wantRunAsNonRoot {
+				t.Errorf("got RunAsNonRoot %v, want %v", got, tt.wantRunAsNonRoot)
+			}
+
+			// The proxy writes its config to a scratch volume instead.
+			if got := hasVolume(pod.Spec.Volumes, proxyConfigVolumeName); got != tt.wantReadOnly {
+				t.Errorf("got volume %s %v, want %v", proxyConfigVolumeName, got, tt.wantReadOnly)
+			}
+			if got := hasVolumeMount(proxy.VolumeMounts, proxyConfigVolumeName); got != tt.wantReadOnly {
+				t.Errorf("got volume mount %s %v, want %v", proxyConfigVolumeName, got, tt.wantReadOnly)
+			}
+		})
+	}
+}
+
+func TestProxyReadOnlyRootFSFeatureGate(t *testing.T) {
+	defer withFeatureGates("")()
+
+	pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{"proxyReadOnlyRootFS": "true"})
+	if hasVolume(pod.Spec.Volumes, proxyConfigVolumeName) {
+		t.Errorf("volume %s was injected without the %s feature gate", proxyConfigVolumeName, featureProxyReadOnlyRootFS)
+	}
+}
+
+func TestInjectedLabelsAndAnnotations(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	pod.Labels = map[string]string{"app": "reviews", "istio.io/rev": "1-5"}
+	pod.Annotations = map[string]string{"team": "bookinfo"}
+
+	pod = injectTestPod(t, pod, map[string]string{
+		"injectedLabels":      "istio.io/rev=1-6, cost-center=mesh, malformed",
+		"injectedAnnotations": "team=platform, injected-by=istio",
+	})
+
+	wantLabels := map[string]string{"app": "reviews", "istio.io/rev": "1-5", "cost-center": "mesh"}
+	if !reflect.DeepEqual(pod.Labels, wantLabels) {
+		t.Errorf("got labels %v, want %v", pod.Labels, wantLabels)
+	}
+
+	for key, want := range map[string]string{"team": "bookinfo", "injected-by": "istio"} {
+		if got := pod.Annotations[key]; got != want {
+			t.Errorf("got annotation %s=%q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestDNSConfig(t *testing.T) {
+	defer withFeatureGates(featureDNSConfig + "=true")()
+
+	t.Run("not configured", func(t *testing.T) {
+		pod := injectTestPod(t, newPendingPod(defaultInitializerName), nil)
+		if pod.Spec.DNSConfig != nil || pod.Spec.DNSPolicy != "" {
+			t.Errorf("got DNS policy %q and config %+v, want the pod's", pod.Spec.DNSPolicy, pod.Spec.DNSConfig)
+		}
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		pod := newPendingPod(defaultInitializerName)
+		pod.Spec.DNSConfig = &corev1.PodDNSConfig{
+			Nameservers: []string{"10.0.0.10"},
+			Searches:    []string{"svc.cluster.local"},
+		}
+
+		pod = injectTestPod(t, pod, map[string]string{
+			"dnsNameservers":   "10.96.0.53,10.0.0.10",
+			"dnsSearchDomains": "mesh",
+		})
+
+		if pod.Spec.DNSPolicy != corev1.DNSNone {
+			t.Errorf("got DNS policy %q, want %q", pod.Spec.DNSPolicy, corev1.DNSNone)
+		}
+		if want := []string{"10.0.0.10", "10.96.0.53"}; !reflect.DeepEqual(pod.Spec.DNSConfig.Nameservers, want) {
+			t.Errorf("got nameservers %v, want %v", pod.Spec.DNSConfig.Nameservers, want)
+		}
+		if want := []string{"svc.cluster.local", "mesh"}; !reflect.DeepEqual(pod.Spec.DNSConfig.Searches, want) {
+			t.Errorf("got search domains %v, want %v", pod.Spec.DNSConfig.Searches, want)
+		}
+	})
+}
+
+func TestSecurityAnnotations(t *testing.T) {
+	const appArmorPrefix = "container.apparmor.security.beta.kubernetes.io/"
+
+	tests := []struct {
+		name          string
+		containerName string
+	}{
+		{
+			name:          "default container name",
+			containerName: defaultProxyContainerName,
+		},
+		{
+			name:          "custom container name",
+			containerName: "envoy",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Annotations = map[string]string{appArmorPrefix + "app": "unconfined"}
+
+			pod = injectTestPod(t, pod, map[string]string{
+				"proxyContainerName":        tt.containerName,
+				"podAnnotationsForSecurity": "apparmor=runtime/default",
+			})
+
+			var got []string
+			for key := range pod.Annotations {
+				if strings.HasPrefix(key, appArmorPrefix) {
+					got = append(got, key)
+				}
+			}
+			sort.Strings(got)
+
+			want := []string{appArmorPrefix + "app", appArmorPrefix + tt.containerName}
+			sort.Strings(want)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got AppArmor annotations %v, want %v", got, want)
+			}
+			if got := pod.Annotations[appArmorPrefix+tt.containerName]; got != "runtime/default" {
+				t.Errorf("got %s profile %q, want runtime/default", tt.containerName, got)
+			}
+			if got := pod.Annotations[appArmorPrefix+"app"]; got != "unconfined" {
+				t.Errorf("app profile changed to %q", got)
+			}
+		})
+	}
+}
+
+func TestCoreDumpMutations(t *testing.T) {
+	defer withFeatureGates(featureShareProcessNamespace + "=true")()
+
+	for _, enabled := range []bool{false, true} {
+		t.Run(fmt.Sprintf("enableCoreDump=%v", enabled), func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+				"enableCoreDump":        fmt.Sprint(enabled),
+				"shareProcessNamespace": "true",
+			})
+			proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+			if proxy == nil {
+				t.Fatalf("container %s was not injected", defaultProxyContainerName)
+			}
+
+			got := map[string]bool{
+				"init container":           hasContainer(pod.Spec.InitContainers, enableCoreDumpContainerName),
+				"volume":                   hasVolume(pod.Spec.Volumes, coreDumpVolumeName),
+				"volume mount":             hasVolumeMount(proxy.VolumeMounts, coreDumpVolumeName),
+				"shared process namespace": pod.Spec.ShareProcessNamespace != nil && *pod.Spec.ShareProcessNamespace,
+			}
+			for mutation, applied := range got {
+				if applied != enabled {
+					t.Errorf("got core dump %s %v, want %v", mutation, applied, enabled)
+				}
+			}
+		})
+	}
+}
+
+func TestStatusPort(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		wantPort    int32
+		wantExclude string
+	}{
+		{
+			name:        "default",
+			wantPort:    15020,
+			wantExclude: "15020",
+		},
+		{
+			name:        "configured",
+			data:        map[string]string{"statusPort": "15021", "excludeInboundPorts": "8080"},
+			wantPort:    15021,
+			wantExclude: "8080,15021",
+		},
+		{
+			name:        "already excluded",
+			data:        map[string]string{"excludeInboundPorts": "15020,8080"},
+			wantPort:    15020,
+			wantExclude: "15020,8080",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, tt.data)
+			pod := newPendingPod()
+
+			proxy := proxyContainer(pod, c)
+			if len(proxy.Ports) != 1 || proxy.Ports[0].Name != "status" || proxy.Ports[0].ContainerPort != tt.wantPort {
+				t.Errorf("got ports %+v, want status port %d", proxy.Ports, tt.wantPort)
+			}
+			if got := proxy.ReadinessProbe.HTTPGet.Port.IntValue(); got != int(tt.wantPort) {
+				t.Errorf("got readiness probe port %d, want %d", got, tt.wantPort)
+			}
+
+			if got := containerArg(t, initContainer(pod, c), "-d"); got != tt.wantExclude {
+				t.Errorf("got -d %q, want %q", got, tt.wantExclude)
+			}
+		})
+	}
+}
+
+func TestPreStopHook(t *testing.T) {
+	tests := []struct {
+		name        string
+		data        map[string]string
+		wantCommand []string
+	}{
+		{
+			name:        "default",
+			wantCommand: []string{"/bin/sh", "-c", "sleep 5"},
+		},
+		{
+			name:        "configured",
+			data:        map[string]string{"proxyDrainDuration": "20s"},
+			wantCommand: []string{"/bin/sh", "-c", "sleep 20"},
+		},
+		{
+			name: "disabled",
+			data: map[string]string{"proxyDrainDuration": "0s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxy := proxyContainer(newPendingPod(), newTestConfig(t, tt.data))
+
+			if tt.wantCommand == nil {
+				if proxy.Lifecycle != nil {
+					t.Errorf("got lifecycle %+v, want none", proxy.Lifecycle)
+				}
+				return
+			}
+
+			if proxy.Lifecycle == nil || proxy.Lifecycle.PreStop == nil || proxy.Lifecycle.PreStop.Exec == nil {
+				t.Fatalf("got lifecycle %+v, want a preStop exec hook", proxy.Lifecycle)
+			}
+			if got := proxy.Lifecycle.PreStop.Exec.Command; !reflect.DeepEqual(got, tt.wantCommand) {
+				t.Errorf("got preStop command %v, want %v", got, tt.wantCommand)
+			}
+		})
+	}
+}
+
+func TestTerminationGracePeriod(t *testing.T) {
+	seconds := func(s int64) *int64 { return &s }
+
+	tests := []struct {
+		name    string
+		data    map[string]string
+		current *int64
+		want    *int64
+	}{
+		{
+			name:    "raised to the drain duration",
+			data:    map[string]string{"proxyDrainDuration": "5s"},
+			current: seconds(5),
+			want:    seconds(10),
+		},
+		{
+			name: "raised to minTerminationGracePeriod",
+			data: map[string]string{"minTerminationGracePeriod": "60s"},
+			want: seconds(60),
+		},
+		{
+			name:    "already long enough",
+			data:    map[string]string{"minTerminationGracePeriod": "60s"},
+			current: seconds(120),
+			want:    seconds(120),
+		},
+		{
+			name: "default grace period long enough",
+			data: map[string]string{"proxyDrainDuration": "5s"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Spec.TerminationGracePeriodSeconds = tt.current
+
+			got := injectTestPod(t, pod, tt.data).Spec.TerminationGracePeriodSeconds
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got termination grace period %v, want %v", ptrString(got), ptrString(tt.want))
+			}
+		})
+	}
+}
+
+func ptrString(p *int64) string {
+	if p == nil {
+		return "unset"
+	}
+	return fmt.Sprintf("%ds", *p)
+}
+
+func TestTokenVolume(t *testing.T) {
+	t.Run("configured", func(t *testing.T) {
+		pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+			"tokenAudience":          "spiffe://cluster.local",
+			"tokenExpirationSeconds": "3600",
+		})
+
+		volume := findVolume(pod.Spec.Volumes, tokenVolumeName)
+		if volume == nil || volume.Projected == nil || len(volume.Projected.Sources) != 1 {
+			t.Fatalf("got volume %+v, want a projected volume %s", volume, tokenVolumeName)
+		}
+		token := volume.Projected.Sources[0].ServiceAccountToken
+		if token == nil {
+			t.Fatal("projected volume has no service account token source")
+		}
+		if token.Audience != "spiffe://cluster.local" {
+			t.Errorf("got audience %q, want spiffe://cluster.local", token.Audience)
+		}
+		if token.ExpirationSeconds == nil || *token.ExpirationSeconds != 3600 {
+			t.Errorf("got expiration %v, want 3600s", ptrString(token.ExpirationSeconds))
+		}
+
+		proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+		if proxy == nil {
+			t.Fatalf("container %s was not injected", defaultProxyContainerName)
+		}
+		mounted := false
+		for _, mount := range proxy.VolumeMounts {
+			if mount.Name == tokenVolumeName && mount.MountPath == tokenMountPath && mount.ReadOnly {
+				mounted = true
+			}
+		}
+		if !mounted {
+			t.Errorf("volume %s is not mounted read-only at %s", tokenVolumeName, tokenMountPath)
+		}
+	})
+
+	t.Run("empty audience", func(t *testing.T) {
+		pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{"tokenAudience": ""})
+
+		if hasVolume(pod.Spec.Volumes, tokenVolumeName) {
+			t.Errorf("volume %s was injected", tokenVolumeName)
+		}
+		if proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName); proxy != nil && hasVolumeMount(proxy.VolumeMounts, tokenVolumeName) {
+			t.Errorf("volume %s was mounted", tokenVolumeName)
+		}
+	})
+}
+
+func TestInitContainerResources(t *testing.T) {
+	tests := []struct {
+		name       string
+		data       map[string]string
+		want       map[corev1.ResourceName]string
+		wantLimits map[corev1.ResourceName]string
+	}{
+		{
+			name: "defaults",
+			want: map[corev1.ResourceName]string{corev1.ResourceCPU: "10m", corev1.ResourceMemory: "10Mi"},
+		},
+		{
+			name: "configured",
+			data: map[string]string{
+				"initCPURequest":    "50m",
+				"initMemoryRequest": "32Mi",
+				"initCPULimit":      "100m",
+				"initMemoryLimit":   "64Mi",
+			},
+			want:       map[corev1.ResourceName]string{corev1.ResourceCPU: "50m", corev1.ResourceMemory: "32Mi"},
+			wantLimits: map[corev1.ResourceName]string{corev1.ResourceCPU: "100m", corev1.ResourceMemory: "64Mi"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), tt.data)
+			container := findContainer(pod.Spec.InitContainers, initContainerName)
+			if container == nil {
+				t.Fatalf("init container %s was not injected", initContainerName)
+			}
+
+			checkResources(t, "request", container.Resources.Requests, tt.want)
+			checkResources(t, "limit", container.Resources.Limits, tt.wantLimits)
+		})
+	}
+}
+
+func TestExtraVolumes(t *testing.T) {
+	pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+		"extraVolumes": `
+- name: ca-bundle
+  configMap:
+    name: custom-ca
+- name: ca-bundle
+  emptyDir: {}
+`,
+		"extraVolumeMounts": `
+- name: ca-bundle
+  mountPath: /etc/custom-ca
+  readOnly: true
+`,
+	})
+
+	var volumes []corev1.Volume
+	for _, volume := range pod.Spec.Volumes {
+		if volume.Name == "ca-bundle" {
+			volumes = append(volumes, volume)
+		}
+	}
+	if len(volumes) != 1 {
+		t.Fatalf("got %d ca-bundle volumes, want 1", len(volumes))
+	}
+	if volumes[0].ConfigMap == nil || volumes[0].ConfigMap.Name != "custom-ca" {
+		t.Errorf("got volume %+v, want the custom-ca configmap", volumes[0])
+	}
+
+	proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+	if proxy == nil {
+		t.Fatalf("container %s was not injected", defaultProxyContainerName)
+	}
+	mounted := false
+	for _, mount := range proxy.VolumeMounts {
+		if mount.Name == "ca-bundle" && mount.MountPath == "/etc/custom-ca" && mount.ReadOnly {
+			mounted = true
+		}
+	}
+	if !mounted {
+		t.Errorf("volume ca-bundle is not mounted read-only at /etc/custom-ca, got mounts %+v", proxy.VolumeMounts)
+	}
+}
+
+func TestProxyConcurrency(t *testing.T) {
+	tests := []struct {
+		name string
+		data map[string]string
+		want string
+	}{
+		{
+			name: "explicit",
+			data: map[string]string{"concurrency": "4", "proxyCPULimit": "1"},
+			want: "4",
+		},
+		{
+			name: "derived from the cpu limit",
+			data: map[string]string{"proxyCPULimit": "1500m"},
+			want: "2",
+		},
+		{
+			name: "zero derives from the cpu limit",
+			data: map[string]string{"concurrency": "0", "proxyCPULimit": "1"},
+			want: "1",
+		},
+		{
+			name: "omitted without a cpu limit",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), tt.data)
+			proxy := findContainer(pod.Spec.Containers, defaultProxyContainerName)
+			if proxy == nil {
+				t.Fatalf("container %s was not injected", defaultProxyContainerName)
+			}
+
+			if tt.want == "" {
+				if containsString(proxy.Args, "--concurrency") {
+					t.Errorf("got --concurrency in args %v, want it omitted", proxy.Args)
+				}
+				return
+			}
+			if got := containerArg(t, *proxy, "--concurrency"); got != tt.want {
+				t.Errorf("got --concurrency %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCNIEnabled(t *testing.T) {
+	for _, enabled := range []bool{true, false} {
+		t.Run(fmt.Sprintf("cniEnabled=%v", enabled), func(t *testing.T) {
+			pod := injectTestPod(t, newPendingPod(defaultInitializerName), map[string]string{
+				"cniEnabled": fmt.Sprint(enabled),
+			})
+
+			if got := findContainer(pod.Spec.InitContainers, initContainerName) != nil; got == enabled {
+				t.Errorf("got init container %s injected %v with cniEnabled=%v", initContainerName, got, enabled)
+			}
+			if !hasContainer(pod.Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+
+			mode, ok := pod.Annotations[interceptionModeAnnotation]
+			if enabled && mode != interceptionModeRedirect {
+				t.Errorf("got annotation %s=%q, want %s", interceptionModeAnnotation, mode, interceptionModeRedirect)
+			}
+			if !enabled && ok {
+				t.Errorf("got annotation %s=%q, want none", interceptionModeAnnotation, mode)
+			}
+		})
+	}
+}
+
+func TestExcludeOutboundPorts(t *testing.T) {
+	tests := []struct {
+		name        string
+		annotations map[string]string
+		data        map[string]string
+		want        string
+	}{
+		{
+			name: "config only",
+			data: map[string]string{"excludeOutboundPorts": "5432"},
+			want: "5432",
+		},
+		{
+			name:        "annotation replaces config",
+			annotations: map[string]string{excludeOutboundPortsAnnotation: "3306,9092"},
+			data:        map[string]string{"excludeOutboundPorts": "5432"},
+			want:        "3306,9092",
+		},
+		{
+			name:        "empty annotation replaces config",
+			annotations: map[string]string{excludeOutboundPortsAnnotation: ""},
+			data:        map[string]string{"excludeOutboundPorts": "5432"},
+		},
+		{
+			name:        "annotation merged with config",
+			annotations: map[string]string{excludeOutboundPortsAnnotation: "3306,5432"},
+			data: map[string]string{
+				"excludeOutboundPorts":     "5432",
+				"excludeOutboundPortsMode": excludePortsMerge,
+			},
+			want: "5432,3306",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Annotations = tt.annotations
+
+			container := initContainer(pod, newTestConfig(t, tt.data))
+			if tt.want == "" {
+				if containsString(container.Args, "-o") {
+					t.Errorf("got -o in args %v, want it omitted", container.Args)
+				}
+				return
+			}
+			if got := containerArg(t, container, "-o"); got != tt.want {
+				t.Errorf("got -o %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCustomProxyContainerName(t *testing.T) {
+	c := newTestConfig(t, map[string]string{"proxyContainerName": "mesh-proxy"})
+
+	once, err := injectSidecar(newPendingPod(defaultInitializerName), c)
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+	if !hasContainer(once.Spec.Containers, "mesh-proxy") {
+		t.Fatal("container mesh-proxy was not injected")
+	}
+	if hasContainer(once.Spec.Containers, defaultProxyContainerName) {
+		t.Errorf("container %s was injected", defaultProxyContainerName)
+	}
+
+	twice, err := injectSidecar(once, c)
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+	if !reflect.DeepEqual(twice, once) {
+		t.Error("injecting an injected pod modified it")
+	}
+
+	// The status annotation alone marks the pod injected, but only for the
+	// proxy container it records.
+	recorded := newPendingPod(defaultInitializerName)
+	recorded.Annotations = map[string]string{statusAnnotation: once.Annotations[statusAnnotation]}
+	if !alreadyInjected(recorded, c) {
+		t.Error("pod annotated with mesh-proxy is not injected")
+	}
+	if alreadyInjected(recorded, newTestConfig(t, nil)) {
+		t.Errorf("pod annotated with mesh-proxy is injected for %s", defaultProxyContainerName)
+	}
+
+	side, err := injectSidecar(once, newTestConfig(t, nil))
+	if err != nil {
+		t.Fatalf("injectSidecar: %v", err)
+	}
+	if !hasContainer(side.Spec.Containers, "mesh-proxy") || !hasContainer(side.Spec.Containers, defaultProxyContainerName) {
+		t.Errorf("got containers %+v, want mesh-proxy and %s side by side", side.Spec.Containers, defaultProxyContainerName)
+	}
+}
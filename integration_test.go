@@ -0,0 +1,160 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	admissionregistrationv1alpha1 "k8s.io/api/admissionregistration/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+const integrationNamespace = "istio-initializer-test"
+
+// integrationAPIServerFlags enables the Initializers admission plugin and the
+// v1alpha1 admissionregistration API it is configured with. The
+// ServiceAccount admission plugin is disabled since envtest runs no
+// controller manager to create the default service account.
+func integrationAPIServerFlags() []string {
+	var flags []string
+	for _, arg := range envtest.DefaultKubeAPIServerFlags {
+		if !strings.HasPrefix(arg, "--admission-control") {
+			flags = append(flags, arg)
+		}
+	}
+	return append(flags,
+		"--enable-admission-plugins=Initializers",
+		"--disable-admission-plugins=ServiceAccount",
+		"--runtime-config=admissionregistration.k8s.io/v1alpha1=true",
+	)
+}
+
+// TestIntegration runs the controller against a real API server and checks
+// that a new pod is injected and released. Initializers were removed in
+// Kubernetes 1.14, so KUBEBUILDER_ASSETS must point at the etcd and
+// kube-apiserver binaries of an older release.
+func TestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the integration test in short mode")
+	}
+
+	env := &envtest.Environment{KubeAPIServerFlags: integrationAPIServerFlags()}
+	restConfig, err := env.Start()
+	if err != nil {
+		t.Fatalf("failed to start the API server: %v", err)
+	}
+	defer env.Stop()
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clientset.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: integrationNamespace},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clientset.CoreV1().ConfigMaps(integrationNamespace).Create(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: testMeshConfig, Namespace: integrationNamespace},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = clientset.AdmissionregistrationV1alpha1().InitializerConfigurations().Create(&admissionregistrationv1alpha1.InitializerConfiguration{
+		ObjectMeta: metav1.ObjectMeta{Name: "istio-initializer"},
+		Initializers: []admissionregistrationv1alpha1.Initializer{
+			{
+				Name: defaultInitializerName,
+				Rules: []admissionregistrationv1alpha1.Rule{
+					{APIGroups: []string{""}, APIVersions: []string{"v1"}, Resources: []string{"pods"}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The admission plugin reloads its configurations once a second.
+	time.Sleep(3 * time.Second)
+
+	// The projected token volume needs a feature gate the API server does
+	// not enable by default.
+	c, err := configmapToConfig(&corev1.ConfigMap{
+		Data: map[string]string{"meshConfig": testMeshConfig, "tokenAudience": ""},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	podInitializer := &initializer{
+		name:       defaultInitializerName,
+		clientset:  clientset,
+		namespaces: newNamespaceCache(clientset, clientset),
+		recorder:   record.NewFakeRecorder(10),
+		audit:      &auditLogger{out: ioutil.Discard},
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	ctrl := newController(clientset, integrationNamespace, newConfigStore(c), podInitializer, time.Minute, time.Minute)
+	go ctrl.run(1, stop)
+
+	// The create request blocks until the pod is initialized or times out.
+	_, err = clientset.CoreV1().Pods(integrationNamespace).Create(&corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: testPodName, Namespace: integrationNamespace},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("failed to create the pod: %v", err)
+	}
+
+	var pod *corev1.Pod
+	err = wait.PollImmediate(100*time.Millisecond, 30*time.Second, func() (bool, error) {
+		var err error
+		pod, err = clientset.CoreV1().Pods(integrationNamespace).Get(testPodName, metav1.GetOptions{IncludeUninitialized: true})
+		if err != nil {
+			return false, err
+		}
+		return pod.ObjectMeta.GetInitializers() == nil, nil
+	})
+	if err != nil {
+		t.Fatalf("pod was not initialized: %v", err)
+	}
+
+	if !hasContainer(pod.Spec.Containers, defaultProxyContainerName) {
+		t.Errorf("container %s was not injected", defaultProxyContainerName)
+	}
+	if !hasContainer(pod.Spec.InitContainers, initContainerName) {
+		t.Errorf("init container %s was not injected", initContainerName)
+	}
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	kubeadmConfigMapNamespace = "kube-system"
+	kubeadmConfigMapName      = "kubeadm-config"
+)
+
+// kubeadmConfigKeys are the kubeadm-config keys holding the cluster
+// networking, newest kubeadm first.
+var kubeadmConfigKeys = []string{"ClusterConfiguration", "MasterConfiguration"}
+
+// kubeadmNetworking is the networking section of the kubeadm cluster config.
+type kubeadmNetworking struct {
+	Networking struct {
+		PodSubnet     string `json:"podSubnet"`
+		ServiceSubnet string `json:"serviceSubnet"`
+	} `json:"networking"`
+}
+
+// detectIPRanges sets includeIPRanges to the cluster pod and service CIDRs
+// when autoDetectIPRanges is set and includeIPRanges is empty. All outbound
+// traffic is captured when the CIDRs cannot be detected.
+func (c *config) detectIPRanges(clientset kubernetes.Interface) {
+	if !c.autoDetectIPRanges || c.includeIPRanges != "" {
+		return
+	}
+
+	cidrs, err := clusterCIDRs(clientset)
+	if err != nil {
+		log.Printf("warning: failed to detect the cluster IP ranges, capturing all outbound traffic: %v", err)
+		c.includeIPRanges = "*"
+		return
+	}
+
+	c.includeIPRanges = strings.Join(cidrs, ",")
+	log.Printf("Detected cluster IP ranges: %s", c.includeIPRanges)
+}
+
+// clusterCIDRs returns the pod and service CIDRs recorded in the kubeadm
+// cluster config.
+func clusterCIDRs(clientset kubernetes.Interface) ([]string, error) {
+	cm, err := clientset.CoreV1().ConfigMaps(kubeadmConfigMapNamespace).Get(kubeadmConfigMapName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range kubeadmConfigKeys {
+		value, ok := cm.Data[key]
+		if !ok {
+			continue
+		}
+
+		var cfg kubeadmNetworking
+		if err := yaml.Unmarshal([]byte(value), &cfg); err != nil {
+			return nil, fmt.Errorf("invalid %s in configmap %s/%s: %v", key, kubeadmConfigMapNamespace, kubeadmConfigMapName, err)
+		}
+
+		cidrs := parseList(cfg.Networking.PodSubnet + "," + cfg.Networking.ServiceSubnet)
+		if len(cidrs) == 0 {
+			return nil, fmt.Errorf("no pod or service subnet in configmap %s/%s", kubeadmConfigMapNamespace, kubeadmConfigMapName)
+		}
+		return cidrs, nil
+	}
+
+	return nil, fmt.Errorf("no cluster configuration in configmap %s/%s", kubeadmConfigMapNamespace, kubeadmConfigMapName)
+}
@@ -0,0 +1,76 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestDetectIPRanges(t *testing.T) {
+	kubeadmConfig := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: kubeadmConfigMapName, Namespace: kubeadmConfigMapNamespace},
+		Data: map[string]string{
+			"ClusterConfiguration": `
+networking:
+  podSubnet: 10.244.0.0/16
+  serviceSubnet: 10.96.0.0/12
+`,
+		},
+	}
+
+	tests := []struct {
+		name    string
+		objects []runtime.Object
+		data    map[string]string
+		want    string
+	}{
+		{
+			name:    "detected",
+			objects: []runtime.Object{kubeadmConfig},
+			data:    map[string]string{"autoDetectIPRanges": "true"},
+			want:    "10.244.0.0/16,10.96.0.0/12",
+		},
+		{
+			name: "detection failed",
+			data: map[string]string{"autoDetectIPRanges": "true"},
+			want: "*",
+		},
+		{
+			name:    "configured ranges win",
+			objects: []runtime.Object{kubeadmConfig},
+			data:    map[string]string{"autoDetectIPRanges": "true", "includeIPRanges": "10.0.0.0/8"},
+			want:    "10.0.0.0/8",
+		},
+		{
+			name:    "detection off",
+			objects: []runtime.Object{kubeadmConfig},
+			want:    "*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, tt.data)
+			c.detectIPRanges(fake.NewSimpleClientset(tt.objects...))
+
+			pod := newPendingPod(defaultInitializerName)
+			if got := containerArg(t, initContainer(pod, c), "-i"); got != tt.want {
+				t.Errorf("got -i %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
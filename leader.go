@@ -0,0 +1,71 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// runLeaderElection campaigns for the named lock and calls run once this
+// replica becomes the leader. onStoppedLeading is called when leadership is
+// lost. It blocks until leadership is lost.
+func runLeaderElection(clientset *kubernetes.Clientset, recorder record.EventRecorder, namespace, name string, run func(stop <-chan struct{}), onStoppedLeading func()) {
+	id, err := os.Hostname()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	lock := &resourcelock.ConfigMapLock{
+		ConfigMapMeta: metav1.ObjectMeta{
+			Namespace: namespace,
+			Name:      name,
+		},
+		Client: clientset.CoreV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity:      id,
+			EventRecorder: recorder,
+		},
+	}
+
+	log.Printf("Waiting to acquire leader lock %s/%s as %s", namespace, name, id)
+
+	leaderelection.RunOrDie(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: leaseDuration,
+		RenewDeadline: renewDeadline,
+		RetryPeriod:   retryPeriod,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				log.Printf("Acquired leader lock %s/%s", namespace, name)
+				run(stop)
+			},
+			OnStoppedLeading: func() {
+				log.Printf("Lost leader lock %s/%s", namespace, name)
+				onStoppedLeading()
+			},
+		},
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	logFormatJSON = "json"
+	logFormatText = "text"
+)
+
+// jsonLogs is set when logs are written as json, one object per line.
+var jsonLogs bool
+
+// setLogFormat switches the standard logger to the given format.
+func setLogFormat(format string, out io.Writer) error {
+	switch format {
+	case logFormatText:
+		jsonLogs = false
+	case logFormatJSON:
+		jsonLogs = true
+		log.SetFlags(0)
+		log.SetOutput(&jsonLogWriter{out: out})
+	default:
+		return fmt.Errorf("unknown log format %q, must be one of: %s, %s", format, logFormatText, logFormatJSON)
+	}
+	return nil
+}
+
+// jsonLogWriter wraps each line written by the standard logger in a json
+// object. The level is taken from the "warning: " and "error: " prefixes the
+// messages use.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	msg := strings.TrimSuffix(string(p), "\n")
+
+	var fields map[string]string
+	if err := json.Unmarshal([]byte(msg), &fields); err != nil || fields["msg"] == "" {
+		fields = map[string]string{"msg": msg}
+	}
+
+	fields["level"] = "info"
+	for _, level := range []string{"warning", "error"} {
+		if strings.HasPrefix(fields["msg"], level+": ") {
+			fields["level"] = level
+			fields["msg"] = strings.TrimPrefix(fields["msg"], level+": ")
+		}
+	}
+	fields["ts"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	line, err := json.Marshal(fields)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// verbosity is the log verbosity of the current config. Messages logged with
+// V(level) are only written when level is at most verbosity.
+var verbosity int32 = 2
+
+func setVerbosity(level int) {
+	atomic.StoreInt32(&verbosity, int32(level))
+}
+
+// verbose writes log messages when its level is enabled.
+type verbose bool
+
+// V reports whether logging at level is enabled. Startup and fatal errors are
+// logged with the log package directly and are always written.
+func V(level int) verbose {
+	return verbose(int32(level) <= atomic.LoadInt32(&verbosity))
+}
+
+func (v verbose) Printf(format string, args ...interface{}) {
+	if v {
+		log.Printf(format, args...)
+	}
+}
+
+func (v verbose) Println(args ...interface{}) {
+	if v {
+		log.Println(args...)
+	}
+}
+
+// PodPrintf logs a message about the pod namespace/name and the error, if
+// any. In the json format they are written as separate fields.
+func (v verbose) PodPrintf(namespace, name string, err error, format string, args ...interface{}) {
+	if !v {
+		return
+	}
+
+	msg := fmt.Sprintf(format, args...)
+	if !jsonLogs {
+		if err != nil {
+			log.Printf("%s, pod: %s/%s: %v", msg, namespace, name, err)
+			return
+		}
+		log.Printf("%s, pod: %s/%s", msg, namespace, name)
+		return
+	}
+
+	fields := map[string]string{"msg": msg, "namespace": namespace, "pod": name}
+	if err != nil {
+		fields["error"] = err.Error()
+	}
+	line, _ := json.Marshal(fields)
+	log.Print(string(line))
+}
+
+// errorLogLimiter logs a given error for a pod at most once per interval, so
+// that a persistent failure does not flood the logs on every retry.
+type errorLogLimiter struct {
+	interval time.Duration
+
+	mu     sync.Mutex
+	logged map[string]time.Time
+}
+
+func newErrorLogLimiter(interval time.Duration) *errorLogLimiter {
+	return &errorLogLimiter{
+		interval: interval,
+		logged:   make(map[string]time.Time),
+	}
+}
+
+// allow reports whether err should be logged for the pod with the given id.
+// Every error is logged when the interval is not positive.
+func (l *errorLogLimiter) allow(id string, err error) bool {
+	if l.interval <= 0 || err == nil {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Expired entries are dropped so that the map only holds the errors
+	// logged within the last interval.
+	now := time.Now()
+	for key, at := range l.logged {
+		if now.Sub(at) >= l.interval {
+			delete(l.logged, key)
+		}
+	}
+
+	// Requeued pods report a varying retry delay, only the reason tells
+	// one requeue from another.
+	message := err.Error()
+	if requeue, ok := err.(*requeueError); ok {
+		message = requeue.reason
+	}
+
+	key := id + "\x00" + message
+	if _, ok := l.logged[key]; ok {
+		return false
+	}
+	l.logged[key] = now
+	return true
+}
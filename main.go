@@ -13,180 +13,960 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
+	"github.com/ghodss/yaml"
 	"github.com/istio/pilot/tools/version"
 
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
-	"k8s.io/apimachinery/pkg/runtime"
-	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
-const initializerName = "initializer.istio.io"
+const (
+	defaultInitializerName = "initializer.istio.io"
+	injectAnnotation       = "sidecar.istio.io/inject"
 
-type config struct {
-	enableCoreDump  bool
-	hub             string
-	includeIPRanges string
-	istioSystem     string
-	meshConfig      string
-	sidecarProxyUID int64
-	tag             string
-	verbosity       int
-	version         string
+	namespaceInjectAnnotation = "istio.io/inject-default"
+
+	modeInitializer = "initializer"
+	modeWebhook     = "webhook"
+
+	updateStrategyPatch  = "patch"
+	updateStrategyUpdate = "update"
+)
+
+// Bounds of the delay before a pod waiting for its required resources is
+// checked again.
+const (
+	requiredResourcesMinRetry = time.Second
+	requiredResourcesMaxRetry = 5 * time.Minute
+)
+
+// startupBackoff retries the initial API server requests for about two
+// minutes, so that a brief control plane outage does not crash the
+// initializer.
+var startupBackoff = wait.Backoff{
+	Duration: 1 * time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    7,
 }
 
 func main() {
 	var kubeconfig *string
-	kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file")
+	kubeconfig = flag.String("kubeconfig", "", "absolute path to the kubeconfig file, uses the in-cluster config when empty")
+	configmapName := flag.String("configmap-name", "istio-initializer", "name of the istio initializer configmap")
+	configmapNames := flag.String("configmap-names", "", "comma-separated istio initializer configmaps merged in order, later ones overriding earlier ones, overrides -configmap-name")
+	configmapNamespace := flag.String("configmap-namespace", "default", "namespace of the istio initializer configmap, defaults to $POD_NAMESPACE when empty")
+	leaderElectName := flag.String("leader-elect-name", "istio-initializer", "name of the leader election lock")
+	leaderElectNamespace := flag.String("leader-elect-namespace", "", "namespace of the leader election lock, defaults to the configmap namespace")
+	metricsAddr := flag.String("metrics-addr", ":9090", "address to serve prometheus metrics on")
+	healthAddr := flag.String("health-addr", ":8080", "address to serve the /healthz and /readyz probes on")
+	dryRun := flag.Bool("dry-run", false, "log the mutated pods instead of updating them")
+	resyncPeriod := flag.Duration("resync-period", defaultResyncPeriod, "informer resync period, overrides the resyncPeriod configmap key when set")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "maximum time to wait for in-flight pods to finish on shutdown")
+	mode := flag.String("mode", modeInitializer, "run as an initializer or as a mutating admission webhook, one of: initializer, webhook")
+	webhookAddr := flag.String("webhook-addr", ":443", "address to serve the admission webhook on")
+	tlsCert := flag.String("tls-cert", "", "path to the webhook TLS certificate")
+	tlsKey := flag.String("tls-key", "", "path to the webhook TLS key")
+	namespaceAllowlist := flag.String("namespace-allowlist", "", "comma-separated namespaces to inject, all namespaces when empty")
+	namespaceDenylist := flag.String("namespace-denylist", "kube-system,kube-public,istio-system", "comma-separated namespaces never to inject, takes precedence over the allowlist")
+	apiTimeout := flag.Duration("api-timeout", 10*time.Second, "timeout of the API server requests made while initializing pods and loading the config")
+	allowMissingConfigMap := flag.Bool("allow-missing-configmap", false, "start with the default config when the istio initializer configmap does not exist")
+	initializerName := flag.String("initializer-name", defaultInitializerName, "name of the initializer pods must be pending on to be injected")
+	slowInjectionThreshold := flag.Duration("slow-injection-threshold", 2*time.Second, "log a warning when initializing a pod takes longer, 0 disables the warning")
+	logFormat := flag.String("log-format", logFormatText, "log format, one of: text, json")
+	once := flag.Bool("once", false, "initialize the pods currently pending on the initializer and exit")
+	featureGatesFlag := flag.String("feature-gates", "", "comma-separated Name=bool pairs enabling experimental injection behaviors: "+strings.Join(knownFeatures, ", "))
+	workerThreads := flag.Int("worker-threads", 2, "number of workers initializing pods concurrently")
+	apiQPS := flag.Float64("api-qps", 5, "maximum queries per second to the API server")
+	apiBurst := flag.Int("api-burst", 10, "maximum burst of queries to the API server")
+	skipRBACCheck := flag.Bool("skip-rbac-check", false, "skip checking the required RBAC permissions at startup")
+	configFile := flag.String("config-file", "", "load the config from a YAML or JSON file of configmap keys instead of the configmap")
+	apiCAFile := flag.String("api-ca-file", "", "path to a CA bundle to verify the API server with, overrides the kubeconfig or in-cluster CA")
+	selfLabelSelector := flag.String("self-label-selector", "app=istio-initializer", "label selector of the initializer's own pods, which are never injected")
+	selfServiceAccount := flag.String("self-service-account", "", "service account of the initializer's own pods, which are never injected")
+	auditLogFile := flag.String("audit-log-file", "", "file to append the injection decision audit log to, stderr when empty")
+	updateStrategy := flag.String("update-strategy", updateStrategyUpdate, "how initialized pods are written back, one of: update, patch")
+	pprofAddr := flag.String("pprof-addr", "", "address to serve the net/http/pprof profiles on, disabled when empty, bind it to localhost")
+	watchNamespace := flag.String("watch-namespace", "", "namespace to watch pods in, all namespaces when empty")
+	driftScanInterval := flag.Duration("drift-scan-interval", 10*time.Minute, "interval of the scan counting injected pods with an outdated config version, 0 disables the scan")
+	errorLogInterval := flag.Duration("error-log-interval", time.Minute, "log the same error for a pod at most once per interval, 0 logs every error")
+	printVersion := flag.Bool("version", false, "print the version and exit")
 	flag.Parse()
 
+	if err := setLogFormat(*logFormat, os.Stderr); err != nil {
+		log.Fatal(err)
+	}
+
+	if *printVersion {
+		fmt.Println(version.Line())
+		fmt.Printf("Initializer name: %s\n", *initializerName)
+		os.Exit(0)
+	}
+
+	if flag.Arg(0) == "list-pending" {
+		listPendingFlags := flag.NewFlagSet("list-pending", flag.ExitOnError)
+		release := listPendingFlags.Bool("release", false, "remove the initializer from the listed pods, releasing them without a sidecar")
+		listPendingFlags.Parse(flag.Args()[1:])
+
+		kconfig, err := buildConfig(*kubeconfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		clientset, err := kubernetes.NewForConfig(kconfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if err := listPending(clientset, *watchNamespace, *initializerName, *release, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
+	switch *mode {
+	case modeInitializer:
+	case modeWebhook:
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Fatal("-tls-cert and -tls-key are required in webhook mode")
+		}
+	default:
+		log.Fatalf("unknown mode %q, must be one of: %s, %s", *mode, modeInitializer, modeWebhook)
+	}
+
+	if *updateStrategy != updateStrategyUpdate && *updateStrategy != updateStrategyPatch {
+		log.Fatalf("unknown update strategy %q, must be one of: %s, %s", *updateStrategy, updateStrategyUpdate, updateStrategyPatch)
+	}
+
+	if *workerThreads < 1 {
+		log.Fatalf("-worker-threads must be positive, got %d", *workerThreads)
+	}
+	if *apiQPS <= 0 || *apiBurst < 1 {
+		log.Fatalf("-api-qps and -api-burst must be positive, got %v and %d", *apiQPS, *apiBurst)
+	}
+
+	if *configmapNamespace == "" {
+		*configmapNamespace = os.Getenv("POD_NAMESPACE")
+	}
+
+	if *leaderElectNamespace == "" {
+		*leaderElectNamespace = *configmapNamespace
+	}
+
 	log.Println("Starting the istio initializer...")
-	log.Printf("Initializer name set to: %s", initializerName)
+	setFeatureGates(*featureGatesFlag)
+	log.Printf("Initializer name set to: %s", *initializerName)
+	if *watchNamespace != "" {
+		log.Printf("Watching pods in namespace: %s", *watchNamespace)
+	} else {
+		log.Println("Watching pods in all namespaces")
+	}
 
-	kconfig, err := clientcmd.BuildConfigFromFlags("", *kubeconfig)
+	go serveMetrics(*metricsAddr)
+
+	var profiler *pprofServer
+	if *pprofAddr != "" {
+		profiler = newPprofServer(*pprofAddr)
+		go profiler.serve()
+	}
+
+	kconfig, err := buildConfig(*kubeconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if *apiCAFile != "" {
+		kconfig.TLSClientConfig.CAFile = *apiCAFile
+		kconfig.TLSClientConfig.CAData = nil
+		log.Printf("Using custom API server CA: %s", *apiCAFile)
+	}
+	logProxyEnvironment()
+
+	kconfig.QPS = float32(*apiQPS)
+	kconfig.Burst = *apiBurst
+	log.Printf("API server rate limit set to: %v qps, %d burst", kconfig.QPS, kconfig.Burst)
 
 	clientset, err := kubernetes.NewForConfig(kconfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	cm, err := clientset.CoreV1().ConfigMaps("default").Get("istio-initializer", metav1.GetOptions{})
+	// The timeout would also cut the long running watches of the informers,
+	// so it only applies to a separate clientset used for single requests. A
+	// timed out pod update is retried by the workqueue.
+	timeoutConfig := *kconfig
+	timeoutConfig.Timeout = *apiTimeout
+	timeoutClientset, err := kubernetes.NewForConfig(&timeoutConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	c, err := configmapToConfig(cm)
+	names := parseList(*configmapNames)
+	if len(names) == 0 {
+		names = []string{*configmapName}
+	}
+
+	var c *config
+	var source string
+	if *configFile != "" {
+		source = "config file " + *configFile
+		c, err = loadConfigFile(*configFile)
+		if err != nil {
+			log.Fatalf("invalid istio initializer %s: %v", source, err)
+		}
+	} else {
+		source = fmt.Sprintf("configmaps %s/%s", *configmapNamespace, strings.Join(names, ","))
+
+		var cms []*corev1.ConfigMap
+		err = retryStartup("loading the istio initializer configmaps", func() error {
+			var err error
+			cms, err = getConfigMaps(timeoutClientset, *configmapNamespace, names)
+			return err
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(cms) == 0 {
+			if !*allowMissingConfigMap {
+				log.Fatalf("istio initializer %s not found", source)
+			}
+			log.Printf("warning: istio initializer %s not found, using the default config", source)
+		}
+
+		c, err = configmapToConfig(cms...)
+		if err != nil {
+			log.Fatalf("invalid istio initializer %s: %v", source, err)
+		}
+	}
+
+	if err := c.validate(); err != nil {
+		log.Fatalf("invalid istio initializer %s: %v", source, err)
+	}
+
+	// The required permissions depend on the config, so they are checked
+	// once it is loaded.
+	if !*skipRBACCheck {
+		permissions := requiredPermissions(c, permissionFlags{
+			mode:                 *mode,
+			updateStrategy:       *updateStrategy,
+			podNamespace:         *watchNamespace,
+			configmapNamespace:   *configmapNamespace,
+			leaderElectNamespace: *leaderElectNamespace,
+			configFile:           *configFile != "",
+			driftScan:            *driftScanInterval > 0,
+			once:                 *once,
+		})
+		if err := checkPermissions(timeoutClientset, permissions); err != nil {
+			log.Fatal(err)
+		}
+	}
+	c.detectIPRanges(timeoutClientset)
+	log.Printf("Loaded configuration from %s", source)
+
+	configs := newConfigStore(c)
+	configLastReload.SetToCurrentTime()
+
+	recorder := newEventRecorder(clientset)
+
+	audit, err := newAuditLogger(*auditLogFile)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	watchlist := cache.NewListWatchFromClient(clientset.Core().RESTClient(), "pods", corev1.NamespaceAll, fields.Everything())
+	selfSelector, err := labels.Parse(*selfLabelSelector)
+	if err != nil {
+		log.Fatalf("invalid -self-label-selector %q: %v", *selfLabelSelector, err)
+	}
 
-	includeUninitializedWatchlist := &cache.ListWatch{
-		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
-			options.IncludeUninitialized = true
-			return watchlist.List(options)
-		},
-		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
-			options.IncludeUninitialized = true
-			return watchlist.Watch(options)
+	podInitializer := &initializer{
+		name:       *initializerName,
+		clientset:  timeoutClientset,
+		namespaces: newNamespaceCache(clientset, timeoutClientset),
+		namespaceFilter: namespaceFilter{
+			allow: parseList(*namespaceAllowlist),
+			deny:  parseList(*namespaceDenylist),
 		},
+		selfSelector:           selfSelector,
+		selfServiceAccount:     *selfServiceAccount,
+		recorder:               recorder,
+		audit:                  audit,
+		updateStrategy:         *updateStrategy,
+		dryRun:                 *dryRun,
+		slowInjectionThreshold: *slowInjectionThreshold,
+	}
+
+	if *once {
+		counts, err := initializePending(timeoutClientset, *watchNamespace, podInitializer, configs.get())
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Initialized %d pending pods, %d left pending, %d failed", counts.initialized, counts.pending, counts.failed)
+		if counts.pending > 0 || counts.failed > 0 {
+			os.Exit(1)
+		}
+		os.Exit(0)
 	}
 
-	resyncPeriod := 30 * time.Second
+	// The resync period is fixed once the informers start, so later changes
+	// to the configmap key require a restart.
+	if !flagSet("resync-period") {
+		*resyncPeriod = c.resyncPeriod
+	}
+	if *resyncPeriod < 0 {
+		log.Printf("warning: negative resync period %v, using default %v", *resyncPeriod, defaultResyncPeriod)
+		*resyncPeriod = defaultResyncPeriod
+	}
+	log.Printf("Resync period set to: %v", *resyncPeriod)
 
-	_, controller := cache.NewInformer(includeUninitializedWatchlist, &corev1.Pod{}, resyncPeriod,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				err := initializePod(obj.(*corev1.Pod), c, clientset)
-				if err != nil {
-					log.Println(err)
-				}
+	stop := make(chan struct{})
+	var stopOnce sync.Once
+	shutdown := func() {
+		stopOnce.Do(func() { close(stop) })
+	}
+
+	go podInitializer.namespaces.run(stop)
+
+	// A config file is read once, only configmaps are reloaded.
+	configSynced := func() bool { return true }
+	if *configFile == "" {
+		configController := newConfigMapInformer(clientset, *configmapNamespace, names, configs, *resyncPeriod)
+		go configController.Run(stop)
+		configSynced = configController.HasSynced
+	}
+
+	if *driftScanInterval > 0 {
+		go runDriftScan(timeoutClientset, *watchNamespace, configs, *driftScanInterval, stop)
+	}
+
+	var podController *controller
+	var health *healthServer
+
+	switch *mode {
+	case modeWebhook:
+		wh := &webhook{
+			configs:     configs,
+			initializer: podInitializer,
+		}
+		go wh.serve(*webhookAddr, *tlsCert, *tlsKey)
+
+		health = newHealthServer(configSynced)
+	default:
+		podController = newController(clientset, *watchNamespace, configs, podInitializer, *resyncPeriod, *errorLogInterval)
+
+		// Only the leader processes pods, standby replicas wait for the lock.
+		go runLeaderElection(clientset, recorder, *leaderElectNamespace, *leaderElectName,
+			func(<-chan struct{}) {
+				podController.run(*workerThreads, stop)
 			},
+			shutdown)
+
+		health = newHealthServer(func() bool {
+			return configSynced() && podController.ready()
 		})
+	}
 
-	stop := make(chan struct{})
-	go controller.Run(stop)
+	go health.serve(*healthAddr)
+	health.setStarted()
+
+	defer logSummary()
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
-	<-signalChan
 
-	log.Println("Shutdown signal received, exiting...")
-	close(stop)
+	select {
+	case <-signalChan:
+		log.Println("Shutdown signal received, exiting...")
+	case <-stop:
+		log.Println("Leadership lost, exiting...")
+	}
+	shutdown()
+
+	if profiler != nil {
+		profiler.shutdown()
+	}
+
+	if podController == nil {
+		return
+	}
+
+	log.Printf("Waiting for in-flight pods to finish, %d pods still queued", podController.queue.Len())
+	if !podController.waitForWorkers(*shutdownTimeout) {
+		log.Printf("Timed out after %v waiting for in-flight pods", *shutdownTimeout)
+	}
 }
 
-func initializePod(pod *corev1.Pod, c *config, clientset *kubernetes.Clientset) error {
-	if pod.ObjectMeta.GetInitializers() != nil {
-		pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
+// retryStartup calls fn with startupBackoff until it succeeds and returns the
+// last error once the backoff is exhausted.
+func retryStartup(what string, fn func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(startupBackoff, func() (bool, error) {
+		lastErr = fn()
+		if lastErr != nil {
+			log.Printf("warning: %s failed, retrying: %v", what, lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return fmt.Errorf("%s failed: %v", what, lastErr)
+	}
+	return err
+}
 
-		if initializerName == pendingInitializers[0].Name {
-			log.Printf("initializing pod: %s", pod.Name)
+// getConfigMaps fetches the named configmaps in order. Missing configmaps are
+// skipped with a warning.
+func getConfigMaps(clientset kubernetes.Interface, namespace string, names []string) ([]*corev1.ConfigMap, error) {
+	var cms []*corev1.ConfigMap
+	for _, name := range names {
+		cm, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			log.Printf("warning: istio initializer configmap %s/%s not found, skipping", namespace, name)
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		cms = append(cms, cm)
+	}
+	return cms, nil
+}
+
+// buildConfig uses the in-cluster service account config unless a kubeconfig
+// path is given.
+func buildConfig(kubeconfig string) (*rest.Config, error) {
+	if kubeconfig == "" {
+		log.Println("No kubeconfig given, using the in-cluster config")
+		return rest.InClusterConfig()
+	}
+
+	log.Printf("Using kubeconfig: %s", kubeconfig)
+	return clientcmd.BuildConfigFromFlags("", kubeconfig)
+}
+
+// logProxyEnvironment logs the HTTP proxy in effect for API server requests.
+// The client-go transport honors the proxy environment variables by default.
+func logProxyEnvironment() {
+	for _, name := range []string{"HTTPS_PROXY", "https_proxy"} {
+		if proxy := os.Getenv(name); proxy != "" {
+			log.Printf("Using proxy for API server requests: %s", proxy)
+			noProxy := os.Getenv("NO_PROXY")
+			if noProxy == "" {
+				noProxy = os.Getenv("no_proxy")
+			}
+			if noProxy != "" {
+				log.Printf("Bypassing the proxy for: %s", noProxy)
+			}
+			return
+		}
+	}
+}
+
+// flagSet reports whether the named flag was set on the command line.
+func flagSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+// initializer initializes pods pending on this initializer.
+type initializer struct {
+	// name is the initializer pods must be pending on.
+	name string
+
+	clientset       kubernetes.Interface
+	namespaces      *namespaceCache
+	namespaceFilter namespaceFilter
+	recorder        record.EventRecorder
+	audit           *auditLogger
+
+	// updateStrategy writes pods back with a full update or a JSON patch.
+	updateStrategy string
+
+	// selfSelector and selfServiceAccount match the initializer's own pods.
+	// Injecting the proxy into the injector could deadlock the mesh bootstrap.
+	selfSelector       labels.Selector
+	selfServiceAccount string
+
+	// dryRun logs the mutated pod instead of updating it. The dryRun
+	// configmap key also enables it.
+	dryRun bool
+
+	// slowInjectionThreshold is the duration above which initializing a pod,
+	// including the update, is logged as slow.
+	slowInjectionThreshold time.Duration
+}
 
-			// Remove self from the list of pending Initializers while preserving ordering.
-			if len(pendingInitializers) == 1 {
-				pod.ObjectMeta.Initializers = nil
-			} else {
-				pod.ObjectMeta.Initializers.Pending = append(pendingInitializers[:0], pendingInitializers[1:]...)
+func (i *initializer) initializePod(pod *corev1.Pod, c *config) error {
+	if !isPendingInitializer(pod, i.name, c.requireFirst) {
+		if isPendingInitializer(pod, i.name, false) {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "pod is pending on initializer %s ahead of %s", pod.ObjectMeta.GetInitializers().Pending[0].Name, i.name)
+		}
+		return nil
+	}
+
+	if first := pod.ObjectMeta.GetInitializers().Pending[0].Name; first != i.name {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "warning: initializing pod ahead of initializer %s because requireFirst is false, initializers ahead of %s will not see the injected sidecar in the order they expect", first, i.name)
+	}
+
+	// Initializers the pod waits for are given up on after the timeout, so
+	// that two initializers waiting for each other do not hold the pod
+	// forever.
+	if waiting := waitingForInitializers(pod, i.name, c.waitForInitializers); len(waiting) > 0 {
+		age := time.Since(pod.CreationTimestamp.Time)
+		if age < c.waitForInitializersTimeout {
+			V(4).PodPrintf(pod.Namespace, pod.Name, nil, "waiting for initializers %s", strings.Join(waiting, ","))
+			return &requeueError{
+				reason: "waiting for initializers " + strings.Join(waiting, ","),
+				after:  c.waitForInitializersTimeout - age,
 			}
+		}
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: timed out after %v waiting for initializers %s, initializing anyway", c.waitForInitializersTimeout, strings.Join(waiting, ","))
+	}
 
-			// Modify the PodSec and post an update.
-			_, err := clientset.CoreV1().Pods(pod.Namespace).Update(pod)
+	V(2).PodPrintf(pod.Namespace, pod.Name, nil, "initializing pod")
+
+	c = c.forPod(pod)
+
+	start := time.Now()
+	defer func() {
+		elapsed := time.Since(start)
+		injectionDuration.Observe(elapsed.Seconds())
+		if i.slowInjectionThreshold > 0 && elapsed > i.slowInjectionThreshold {
+			V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: slow injection took %v", elapsed)
+		}
+	}()
+
+	skipReason, err := i.skipInjection(pod, c)
+	if err != nil {
+		return err
+	}
+
+	if skipReason == "" {
+		if c.preInjectionChecks {
+			// Leave the pod pending and retry with backoff until the
+			// resources the proxy depends on exist.
+			if err := i.checkRequiredResources(pod, c); err != nil {
+				return err
+			}
+		} else {
+			i.checkCertSecret(pod, c)
+		}
+		c = i.bootstrapOverride(pod, c)
+	}
+
+	// In dry-run mode the pod is left pending on this initializer so that it
+	// is not released half-configured.
+	if i.dryRun || c.dryRun {
+		if skipReason == "" {
+			pod, err = injectSidecar(pod, c)
 			if err != nil {
 				return err
 			}
 		}
+
+		out, err := yaml.Marshal(pod)
+		if err != nil {
+			return err
+		}
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "dry-run: mutated pod:\n%s", out)
+		return nil
+	}
+
+	updated := false
+
+	// On conflict re-fetch the pod and re-apply the mutation to the latest version.
+	refetch := false
+	err = retry.RetryOnConflict(retry.DefaultBackoff, func() error {
+		if refetch {
+			latest, err := i.clientset.CoreV1().Pods(pod.Namespace).Get(pod.Name, metav1.GetOptions{IncludeUninitialized: true})
+			if err != nil {
+				return err
+			}
+			if !isPendingInitializer(latest, i.name, c.requireFirst) {
+				return nil
+			}
+			pod = latest
+		}
+		refetch = true
+
+		original := pod
+		if skipReason == "" {
+			injected, err := injectSidecar(pod, c)
+			if err != nil {
+				return err
+			}
+			pod = injected
+		} else {
+			pod = pod.DeepCopy()
+		}
+		removePendingInitializer(pod, i.name)
+
+		// Modify the PodSec and post an update.
+		err := i.updatePod(original, pod)
+		if err != nil {
+			return err
+		}
+		updated = true
+		return nil
+	})
+	// The pod was deleted after it was queued, there is nothing left to do.
+	if errors.IsNotFound(err) {
+		V(4).PodPrintf(pod.Namespace, pod.Name, nil, "pod deleted before it was initialized")
+		return nil
+	}
+	if err != nil {
+		// Conflicts retried above are not failures, each pod left
+		// uninitialized counts once.
+		updateErrors.Inc()
+		i.recorder.Eventf(pod, corev1.EventTypeWarning, eventReasonInjectionFailed, "Failed to inject sidecar %s: %v", c.proxyImage(), err)
+		return err
+	}
+
+	if updated {
+		if skipReason == "" {
+			i.recorder.Eventf(pod, corev1.EventTypeNormal, eventReasonSidecarInjected, "Injected sidecar %s", c.proxyImage())
+			podsInjected.Inc()
+			i.audit.record(pod, auditDecisionInjected, "", c)
+		} else {
+			podsSkipped.WithLabelValues(skipReason).Inc()
+			i.audit.record(pod, auditDecisionSkipped, skipReason, c)
+		}
 	}
 
 	return nil
 }
 
-func configmapToConfig(c *corev1.ConfigMap) (*config, error) {
-	var enableCoreDump bool
-	var err error
+// updatePod writes the mutated pod back, either as a full update or as a
+// JSON patch against the original pod depending on the update strategy.
+func (i *initializer) updatePod(original, mutated *corev1.Pod) error {
+	logPodDiff(original, mutated)
+
+	if i.updateStrategy == updateStrategyPatch {
+		patch, err := createPatch(original, mutated)
+		if err != nil {
+			return err
+		}
+		_, err = i.clientset.CoreV1().Pods(mutated.Namespace).Patch(mutated.Name, types.JSONPatchType, patch)
+		return err
+	}
+
+	_, err := i.clientset.CoreV1().Pods(mutated.Namespace).Update(mutated)
+	return err
+}
+
+// waitingForInitializers returns the initializers of wait the pod is still
+// pending on ahead of the named one. Initializers behind it wait for it in
+// turn, so they are not waited for.
+func waitingForInitializers(pod *corev1.Pod, name string, wait []string) []string {
+	if pod.ObjectMeta.GetInitializers() == nil {
+		return nil
+	}
+
+	var waiting []string
+	for _, pending := range pod.ObjectMeta.GetInitializers().Pending {
+		if pending.Name == name {
+			break
+		}
+		if containsString(wait, pending.Name) {
+			waiting = append(waiting, pending.Name)
+		}
+	}
+	return waiting
+}
+
+// isPendingInitializer reports whether the pod is pending on the named
+// initializer. Unless requireFirst is false, the initializer must also be
+// first in the pod's list of pending initializers.
+func isPendingInitializer(pod *corev1.Pod, name string, requireFirst bool) bool {
+	if pod.ObjectMeta.GetInitializers() == nil {
+		return false
+	}
+
+	pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
+	if len(pendingInitializers) == 0 {
+		return false
+	}
+
+	if name == pendingInitializers[0].Name {
+		return true
+	}
+
+	for _, pending := range pendingInitializers[1:] {
+		if pending.Name != name {
+			continue
+		}
+
+		return !requireFirst
+	}
+
+	return false
+}
+
+// skipInjection returns the reason sidecar injection is skipped for the pod,
+// or an empty string when the sidecar should be injected.
+func (i *initializer) skipInjection(pod *corev1.Pod, c *config) (string, error) {
+	// Catching up on old events can deliver pods that are already done.
+	if pod.ObjectMeta.DeletionTimestamp != nil {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod is terminating")
+		return skipReasonPhase, nil
+	}
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod is %s", pod.Status.Phase)
+		return skipReasonPhase, nil
+	}
 
-	enableCoreDump, err = strconv.ParseBool(c.Data["enableCoreDump"])
+	if i.isSelf(pod) {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod belongs to the initializer")
+		return skipReasonSelf, nil
+	}
+
+	if alreadyInjected(pod, c) {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, sidecar already injected")
+		return skipReasonAlreadyInjected, nil
+	}
+
+	// Redirecting traffic with iptables in the node's network namespace would
+	// break traffic for the whole node.
+	if pod.Spec.HostNetwork {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod uses the host network")
+		return skipReasonHostNetwork, nil
+	}
+
+	if !i.namespaceFilter.allowed(pod.Namespace) {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, namespace %s is not allowed", pod.Namespace)
+		return skipReasonNamespace, nil
+	}
+
+	// A pod opted in by annotation is injected even when its namespace is
+	// not selected.
+	inject, set := podInjectAnnotation(pod)
+	if !set || !inject {
+		selected, err := namespaceSelected(pod.Namespace, c, i.namespaces)
+		if err != nil {
+			return "", err
+		}
+		if !selected {
+			V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, namespace %s is not selected", pod.Namespace)
+			return skipReasonNamespace, nil
+		}
+	}
+
+	if !c.podSelector.Matches(labels.Set(pod.Labels)) {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod labels do not match the pod selector")
+		return skipReasonPodSelector, nil
+	}
+
+	skipReason, err := i.injectionPolicy(pod, c)
+	if err != nil || skipReason != "" {
+		return skipReason, err
+	}
+
+	// A pod opted in by annotation is injected whatever its owner.
+	if !set || !inject {
+		for _, owner := range pod.ObjectMeta.OwnerReferences {
+			for _, kind := range c.skipOwnerKinds {
+				if owner.Kind == kind {
+					V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, pod is owned by %s %s", owner.Kind, owner.Name)
+					return skipReasonOwnerKind, nil
+				}
+			}
+		}
+	}
+
+	// The pre-injection checks wait for the mesh config instead.
+	if c.preInjectionChecks {
+		return "", nil
+	}
+
+	// The mesh config is mounted as a volume, which requires the configmap to
+	// exist in the pod's namespace.
+	_, err = i.clientset.CoreV1().ConfigMaps(pod.Namespace).Get(c.meshConfig, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "error: skipping sidecar injection, mesh config configmap %s/%s not found", pod.Namespace, c.meshConfig)
+		return skipReasonMeshConfig, nil
+	}
 	if err != nil {
-		enableCoreDump = false
+		return "", err
 	}
 
-	var sidecarProxyUID int64
-	sidecarProxyUID, err = strconv.ParseInt(c.Data["sidecarProxyUID"], 10, 64)
+	return "", nil
+}
+
+// podInjectAnnotation returns the value of the pod's inject annotation and
+// whether it is set. Unparsable values are treated as not set.
+func podInjectAnnotation(pod *corev1.Pod) (bool, bool) {
+	value, ok := pod.ObjectMeta.GetAnnotations()[injectAnnotation]
+	if !ok {
+		return false, false
+	}
+
+	inject, err := strconv.ParseBool(value)
 	if err != nil {
-		sidecarProxyUID = int64(1337)
+		return false, false
+	}
+	return inject, true
+}
+
+// isSelf reports whether the pod is one of the initializer's own pods.
+func (i *initializer) isSelf(pod *corev1.Pod) bool {
+	if i.selfServiceAccount != "" && pod.Spec.ServiceAccountName == i.selfServiceAccount {
+		return true
+	}
+	return i.selfSelector != nil && !i.selfSelector.Empty() && i.selfSelector.Matches(labels.Set(pod.Labels))
+}
+
+// checkRequiredResources returns an error when one of the requiredResources
+// does not exist in the pod's namespace.
+func (i *initializer) checkRequiredResources(pod *corev1.Pod, c *config) error {
+	for _, ref := range c.requiredResources {
+		kind, name, err := parseRequiredResource(ref)
+		if err != nil {
+			return err
+		}
+
+		switch kind {
+		case requiredConfigMap:
+			_, err = i.clientset.CoreV1().ConfigMaps(pod.Namespace).Get(name, metav1.GetOptions{})
+		case requiredSecret:
+			_, err = i.clientset.CoreV1().Secrets(pod.Namespace).Get(name, metav1.GetOptions{})
+		}
+		if errors.IsNotFound(err) {
+			return &requeueError{
+				reason: fmt.Sprintf("required %s %s/%s not found", kind, pod.Namespace, name),
+				after:  requiredResourcesRetry(pod),
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// requiredResourcesRetry returns the delay before a pod waiting for its
+// required resources is checked again. It grows with the age of the pod so
+// that long missing resources are polled less often.
+func requiredResourcesRetry(pod *corev1.Pod) time.Duration {
+	delay := time.Since(pod.CreationTimestamp.Time)
+	if delay < requiredResourcesMinRetry {
+		return requiredResourcesMinRetry
+	}
+	if delay > requiredResourcesMaxRetry {
+		return requiredResourcesMaxRetry
 	}
+	return delay
+}
 
-	var verbosity int
-	verbosity, err = strconv.Atoi(c.Data["verbosity"])
+// checkCertSecret logs a warning when the certificate secret mounted into the
+// proxy does not exist in the pod's namespace. Secrets cannot be mounted across
+// namespaces, so the proxy starts without certificates until it is created.
+func (i *initializer) checkCertSecret(pod *corev1.Pod, c *config) {
+	_, err := i.clientset.CoreV1().Secrets(pod.Namespace).Get(c.caCertSecret, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: certificate secret %s/%s not found", pod.Namespace, c.caCertSecret)
+		return
+	}
 	if err != nil {
-		verbosity = 2
+		V(0).PodPrintf(pod.Namespace, pod.Name, err, "warning: unable to verify certificate secret %s/%s", pod.Namespace, c.caCertSecret)
 	}
+}
 
-	cfg := &config{
-		enableCoreDump:  enableCoreDump,
-		hub:             c.Data["hub"],
-		includeIPRanges: c.Data["includeIPRanges"],
-		istioSystem:     c.Data["istioSystem"],
-		meshConfig:      c.Data["meshConfig"],
-		sidecarProxyUID: sidecarProxyUID,
-		tag:             c.Data["tag"],
-		verbosity:       verbosity,
-		version:         c.Data["version"],
+// bootstrapOverride returns the config for a pod that requests a custom proxy
+// bootstrap with the bootstrap override annotation. The override is ignored
+// with a warning when the configmap it names does not exist in the pod's
+// namespace.
+func (i *initializer) bootstrapOverride(pod *corev1.Pod, c *config) *config {
+	name := pod.ObjectMeta.GetAnnotations()[bootstrapOverrideAnnotation]
+	if name == "" {
+		return c
 	}
 
-	if cfg.hub == "" {
-		cfg.hub = "docker.io/istio"
+	_, err := i.clientset.CoreV1().ConfigMaps(pod.Namespace).Get(name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		V(0).PodPrintf(pod.Namespace, pod.Name, nil, "warning: ignoring bootstrap override, configmap %s/%s not found", pod.Namespace, name)
+		return c
+	}
+	if err != nil {
+		V(0).PodPrintf(pod.Namespace, pod.Name, err, "warning: ignoring bootstrap override, unable to verify configmap %s/%s", pod.Namespace, name)
+		return c
 	}
 
-	if cfg.istioSystem == "" {
-		cfg.istioSystem = "default"
+	overridden := *c
+	overridden.bootstrapConfigMap = name
+	return &overridden
+}
+
+// removePendingInitializer removes the named initializer from the pod's
+// pending initializers.
+func removePendingInitializer(pod *corev1.Pod, name string) {
+	if pod.ObjectMeta.GetInitializers() == nil {
+		return
 	}
+	pendingInitializers := pod.ObjectMeta.GetInitializers().Pending
 
-	if cfg.meshConfig == "" {
-		cfg.meshConfig = "istio"
+	// Remove self from the list of pending Initializers while preserving ordering.
+	for i, pending := range pendingInitializers {
+		if pending.Name == name {
+			pendingInitializers = append(pendingInitializers[:i], pendingInitializers[i+1:]...)
+			break
+		}
 	}
 
-	if cfg.tag == "" {
-		cfg.tag = "0.1"
+	if len(pendingInitializers) == 0 {
+		pod.ObjectMeta.Initializers = nil
+	} else {
+		pod.ObjectMeta.Initializers.Pending = pendingInitializers
 	}
+}
 
-	if cfg.version == "" {
-		cfg.version = version.Line()
+// injectionPolicy returns the skip reason when the pod is opted out of sidecar
+// injection. The pod annotation takes precedence over the namespace
+// annotation, which takes precedence over the policy configmap key.
+func (i *initializer) injectionPolicy(pod *corev1.Pod, c *config) (string, error) {
+	if inject, set := podInjectAnnotation(pod); set {
+		if !inject {
+			V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, %s is false", injectAnnotation)
+			return skipReasonAnnotation, nil
+		}
+		return "", nil
 	}
 
-	return cfg, nil
+	annotations, err := i.namespaces.annotations(pod.Namespace)
+	if err != nil {
+		return "", err
+	}
+	switch annotations[namespaceInjectAnnotation] {
+	case policyEnabled:
+		return "", nil
+	case policyDisabled:
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, %s is %s on namespace %s", namespaceInjectAnnotation, policyDisabled, pod.Namespace)
+		return skipReasonNamespaceAnnotation, nil
+	}
+
+	if c.policy == policyDisabled {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "skipping sidecar injection, injection policy is %s", policyDisabled)
+		return skipReasonPolicy, nil
+	}
+	return "", nil
 }
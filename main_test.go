@@ -0,0 +1,888 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	testNamespace = "default"
+	testPodName   = "test"
+
+	// testMeshConfig is the default of the meshConfig configmap key.
+	testMeshConfig = "istio"
+)
+
+// newPendingPod returns a pod pending on the named initializers, in order.
+func newPendingPod(names ...string) *corev1.Pod {
+	pending := make([]metav1.Initializer, 0, len(names))
+	for _, name := range names {
+		pending = append(pending, metav1.Initializer{Name: name})
+	}
+
+	return &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:         testPodName,
+			Namespace:    testNamespace,
+			Initializers: &metav1.Initializers{Pending: pending},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{
+				{Name: "app", Image: "app"},
+			},
+		},
+	}
+}
+
+// newTestInitializer returns an initializer backed by a fake clientset that
+// holds objects along with the pod's namespace and mesh config.
+func newTestInitializer(objects ...runtime.Object) (*initializer, *fake.Clientset) {
+	objects = append(objects,
+		&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: testNamespace},
+		},
+		&corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: testMeshConfig, Namespace: testNamespace},
+		},
+	)
+	clientset := fake.NewSimpleClientset(objects...)
+
+	return &initializer{
+		name:       defaultInitializerName,
+		clientset:  clientset,
+		namespaces: newNamespaceCache(clientset, clientset),
+		recorder:   record.NewFakeRecorder(10),
+		audit:      &auditLogger{out: ioutil.Discard},
+	}, clientset
+}
+
+// newTestConfig returns the config built from the configmap data, the
+// defaults when data is nil.
+func newTestConfig(t *testing.T, data map[string]string) *config {
+	c, err := configmapToConfig(&corev1.ConfigMap{Data: data})
+	if err != nil {
+		t.Fatalf("configmapToConfig: %v", err)
+	}
+	return c
+}
+
+// withFeatureGates enables the feature gates until the returned function is
+// called.
+func withFeatureGates(value string) func() {
+	saved := featureGates
+	setFeatureGates(value)
+	return func() { featureGates = saved }
+}
+
+// podUpdates returns the pods written back through the fake clientset.
+func podUpdates(clientset *fake.Clientset) []*corev1.Pod {
+	var pods []*corev1.Pod
+	for _, action := range clientset.Actions() {
+		update, ok := action.(k8stesting.UpdateAction)
+		if !ok || update.GetResource().Resource != "pods" {
+			continue
+		}
+		if pod, ok := update.GetObject().(*corev1.Pod); ok {
+			pods = append(pods, pod)
+		}
+	}
+	return pods
+}
+
+func pendingNames(pod *corev1.Pod) []string {
+	var names []string
+	if pod.ObjectMeta.GetInitializers() == nil {
+		return names
+	}
+	for _, pending := range pod.ObjectMeta.GetInitializers().Pending {
+		names = append(names, pending.Name)
+	}
+	return names
+}
+
+func TestInitializePod(t *testing.T) {
+	tests := []struct {
+		name        string
+		pending     []string
+		wantUpdates int
+		wantPending []string
+	}{
+		{
+			name:        "only initializer",
+			pending:     []string{defaultInitializerName},
+			wantUpdates: 1,
+		},
+		{
+			name:        "first of several",
+			pending:     []string{defaultInitializerName, "a.example.com", "b.example.com"},
+			wantUpdates: 1,
+			wantPending: []string{"a.example.com", "b.example.com"},
+		},
+		{
+			name:        "behind another initializer",
+			pending:     []string{"a.example.com", defaultInitializerName},
+			wantUpdates: 0,
+		},
+		{
+			name:        "not pending",
+			pending:     []string{"a.example.com"},
+			wantUpdates: 0,
+		},
+		{
+			name:        "empty pending list",
+			pending:     []string{},
+			wantUpdates: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(tt.pending...)
+			podInitializer, clientset := newTestInitializer(pod)
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("initializePod panicked: %v", r)
+				}
+			}()
+
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+
+			updates := podUpdates(clientset)
+			if len(updates) != tt.wantUpdates {
+				t.Fatalf("got %d pod updates, want %d", len(updates), tt.wantUpdates)
+			}
+			if tt.wantUpdates == 0 {
+				return
+			}
+
+			if got := pendingNames(updates[0]); !reflect.DeepEqual(got, tt.wantPending) {
+				t.Errorf("got pending initializers %v, want %v", got, tt.wantPending)
+			}
+		})
+	}
+}
+
+func TestInitializeDegeneratePod(t *testing.T) {
+	tests := []struct {
+		name        string
+		mutate      func(pod *corev1.Pod)
+		wantUpdates int
+	}{
+		{
+			name:        "nil containers",
+			mutate:      func(pod *corev1.Pod) { pod.Spec.Containers = nil },
+			wantUpdates: 1,
+		},
+		{
+			name:        "empty containers",
+			mutate:      func(pod *corev1.Pod) { pod.Spec.Containers = []corev1.Container{} },
+			wantUpdates: 1,
+		},
+		{
+			name: "nil labels, annotations and owners",
+			mutate: func(pod *corev1.Pod) {
+				pod.Labels = nil
+				pod.Annotations = nil
+				pod.OwnerReferences = nil
+			},
+			wantUpdates: 1,
+		},
+		{
+			name: "empty labels, annotations and owners",
+			mutate: func(pod *corev1.Pod) {
+				pod.Labels = map[string]string{}
+				pod.Annotations = map[string]string{}
+				pod.OwnerReferences = []metav1.OwnerReference{}
+			},
+			wantUpdates: 1,
+		},
+		{
+			name: "owner without name",
+			mutate: func(pod *corev1.Pod) {
+				pod.OwnerReferences = []metav1.OwnerReference{{Kind: "ReplicaSet"}}
+			},
+			wantUpdates: 1,
+		},
+		{
+			name:   "nil initializers",
+			mutate: func(pod *corev1.Pod) { pod.Initializers = nil },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			tt.mutate(pod)
+			podInitializer, clientset := newTestInitializer(pod)
+
+			defer func() {
+				if r := recover(); r != nil {
+					t.Fatalf("initializePod panicked: %v", r)
+				}
+			}()
+
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+
+			updates := podUpdates(clientset)
+			if len(updates) != tt.wantUpdates {
+				t.Fatalf("got %d pod updates, want %d", len(updates), tt.wantUpdates)
+			}
+			if tt.wantUpdates == 0 {
+				return
+			}
+
+			if !hasContainer(updates[0].Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+			if got := pendingNames(updates[0]); len(got) != 0 {
+				t.Errorf("got pending initializers %v, want none", got)
+			}
+		})
+	}
+}
+
+func TestInitializePodConflict(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	podInitializer, clientset := newTestInitializer(pod)
+
+	// The first update conflicts with a concurrent writer that labeled the
+	// pod, the retry must mutate that latest version.
+	conflicted := false
+	clientset.PrependReactor("update", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+
+		latest := pod.DeepCopy()
+		latest.Labels = map[string]string{"version": "latest"}
+		if err := clientset.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), latest, testNamespace); err != nil {
+			t.Fatalf("updating the stored pod: %v", err)
+		}
+		return true, nil, errors.NewConflict(schema.GroupResource{Resource: "pods"}, pod.Name, fmt.Errorf("the object has been modified"))
+	})
+
+	if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+
+	updates := podUpdates(clientset)
+	if len(updates) != 2 {
+		t.Fatalf("got %d pod updates, want 2", len(updates))
+	}
+
+	retried := updates[1]
+	if retried.Labels["version"] != "latest" {
+		t.Errorf("retried update was not based on the re-fetched pod, got labels %v", retried.Labels)
+	}
+	if !hasContainer(retried.Spec.Containers, defaultProxyContainerName) {
+		t.Errorf("container %s was not injected into the re-fetched pod", defaultProxyContainerName)
+	}
+	if got := pendingNames(retried); len(got) != 0 {
+		t.Errorf("got pending initializers %v, want none", got)
+	}
+}
+
+// initializeTestPod initializes the pod with the config built from data and
+// returns the single update written back.
+func initializeTestPod(t *testing.T, pod *corev1.Pod, data map[string]string) *corev1.Pod {
+	t.Helper()
+
+	podInitializer, clientset := newTestInitializer(pod)
+	if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, data)); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+
+	updates := podUpdates(clientset)
+	if len(updates) != 1 {
+		t.Fatalf("got %d pod updates, want 1", len(updates))
+	}
+	if got := pendingNames(updates[0]); len(got) != 0 {
+		t.Errorf("got pending initializers %v, want none", got)
+	}
+	return updates[0]
+}
+
+// checkNotInjected fails unless the pod is updated as it was given, without
+// the sidecar.
+func checkNotInjected(t *testing.T, pod, updated *corev1.Pod) {
+	t.Helper()
+
+	if !reflect.DeepEqual(updated.Spec, pod.Spec) {
+		t.Errorf("pod spec was modified:\ngot  %+v\nwant %+v", updated.Spec, pod.Spec)
+	}
+	if _, ok := updated.Annotations[statusAnnotation]; ok {
+		t.Errorf("pod was annotated with %s", statusAnnotation)
+	}
+}
+
+func TestInitializeHostNetworkPod(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	pod.Spec.HostNetwork = true
+
+	checkNotInjected(t, pod, initializeTestPod(t, pod, nil))
+}
+
+func TestInitializeOwnedPod(t *testing.T) {
+	tests := []struct {
+		name        string
+		ownerKind   string
+		annotations map[string]string
+		data        map[string]string
+		wantSkip    bool
+	}{
+		{
+			name:      "DaemonSet skipped by default",
+			ownerKind: "DaemonSet",
+			wantSkip:  true,
+		},
+		{
+			name:        "DaemonSet opted in by annotation",
+			ownerKind:   "DaemonSet",
+			annotations: map[string]string{injectAnnotation: "true"},
+		},
+		{
+			name:      "DaemonSet default overridden",
+			ownerKind: "DaemonSet",
+			data:      map[string]string{"skipOwnerKinds": "Job"},
+		},
+		{
+			name:      "skipped owner kind",
+			ownerKind: "Job",
+			data:      map[string]string{"skipOwnerKinds": "Job"},
+			wantSkip:  true,
+		},
+		{
+			name:      "other owner kind",
+			ownerKind: "ReplicaSet",
+			data:      map[string]string{"skipOwnerKinds": "Job"},
+		},
+		{
+			name:      "empty skipOwnerKinds",
+			ownerKind: "Job",
+			data:      map[string]string{"skipOwnerKinds": ""},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.OwnerReferences = []metav1.OwnerReference{{Kind: tt.ownerKind, Name: "owner"}}
+			pod.Annotations = tt.annotations
+
+			updated := initializeTestPod(t, pod, tt.data)
+			if tt.wantSkip {
+				checkNotInjected(t, pod, updated)
+				return
+			}
+			if !hasContainer(updated.Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+		})
+	}
+}
+
+func TestGetConfigMaps(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "override", Namespace: "istio-system"}},
+		&corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "base", Namespace: "istio-system"}},
+	)
+
+	cms, err := getConfigMaps(clientset, "istio-system", []string{"base", "missing", "override"})
+	if err != nil {
+		t.Fatalf("getConfigMaps: %v", err)
+	}
+
+	var got []string
+	for _, cm := range cms {
+		got = append(got, cm.Name)
+	}
+	if want := []string{"base", "override"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got configmaps %v, want %v", got, want)
+	}
+}
+
+func TestInitializePolicy(t *testing.T) {
+	for _, policy := range []string{policyEnabled, policyDisabled} {
+		t.Run(policy, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			updated := initializeTestPod(t, pod, map[string]string{"policy": policy})
+
+			if policy == policyDisabled {
+				checkNotInjected(t, pod, updated)
+				return
+			}
+			if !hasContainer(updated.Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+		})
+	}
+}
+
+func TestInitializeSucceededPod(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	pod.Status.Phase = corev1.PodSucceeded
+
+	before, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+
+	checkNotInjected(t, pod, initializeTestPod(t, pod, nil))
+
+	after, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+	if got := after.skipped[skipReasonPhase] - before.skipped[skipReasonPhase]; got != 1 {
+		t.Errorf("got %.0f pods skipped for %s, want 1", got, skipReasonPhase)
+	}
+}
+
+func TestInitializePodSelector(t *testing.T) {
+	data := map[string]string{"podSelector": "istio-injection=enabled"}
+
+	tests := []struct {
+		name       string
+		labels     map[string]string
+		wantInject bool
+	}{
+		{
+			name:       "matching",
+			labels:     map[string]string{"app": "reviews", "istio-injection": "enabled"},
+			wantInject: true,
+		},
+		{
+			name:   "other value",
+			labels: map[string]string{"istio-injection": "disabled"},
+		},
+		{
+			name: "no labels",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Labels = tt.labels
+
+			updated := initializeTestPod(t, pod, data)
+			if !tt.wantInject {
+				checkNotInjected(t, pod, updated)
+				return
+			}
+			if !hasContainer(updated.Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+		})
+	}
+
+	if _, err := configmapToConfig(&corev1.ConfigMap{Data: map[string]string{"podSelector": "istio-injection in (enabled"}}); err == nil {
+		t.Error("got no error for a malformed podSelector")
+	}
+}
+
+func TestInitializerName(t *testing.T) {
+	const canaryName = "canary.initializer.istio.io"
+
+	tests := []struct {
+		name        string
+		pending     string
+		wantUpdates int
+	}{
+		{
+			name:        "configured name",
+			pending:     canaryName,
+			wantUpdates: 1,
+		},
+		{
+			name:    "default name",
+			pending: defaultInitializerName,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(tt.pending)
+			podInitializer, clientset := newTestInitializer(pod)
+			podInitializer.name = canaryName
+
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+
+			if got := len(podUpdates(clientset)); got != tt.wantUpdates {
+				t.Errorf("got %d pod updates, want %d", got, tt.wantUpdates)
+			}
+		})
+	}
+}
+
+func TestInitializePodBecomesFirst(t *testing.T) {
+	pod := newPendingPod("a.example.com", defaultInitializerName)
+	podInitializer, clientset := newTestInitializer(pod)
+	c := newTestConfig(t, nil)
+
+	if err := podInitializer.initializePod(pod.DeepCopy(), c); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+	if got := len(podUpdates(clientset)); got != 0 {
+		t.Fatalf("got %d pod updates behind another initializer, want 0", got)
+	}
+
+	// The other initializer removes itself, the update event delivers the
+	// pod with this initializer first.
+	updated := pod.DeepCopy()
+	updated.Initializers.Pending = updated.Initializers.Pending[1:]
+	if err := clientset.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), updated, testNamespace); err != nil {
+		t.Fatalf("updating the stored pod: %v", err)
+	}
+	if !isPendingInitializer(updated, podInitializer.name, false) {
+		t.Fatal("updated pod would not be queued")
+	}
+
+	if err := podInitializer.initializePod(updated.DeepCopy(), c); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+	updates := podUpdates(clientset)
+	if len(updates) != 1 {
+		t.Fatalf("got %d pod updates once first, want 1", len(updates))
+	}
+	if !hasContainer(updates[0].Spec.Containers, defaultProxyContainerName) {
+		t.Errorf("container %s was not injected", defaultProxyContainerName)
+	}
+
+	// The update written back no longer lists this initializer and is not
+	// queued again.
+	if isPendingInitializer(updates[0], podInitializer.name, false) {
+		t.Error("injected pod would be queued again")
+	}
+}
+
+func TestInitializeDeletedPod(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	podInitializer, clientset := newTestInitializer(pod)
+	clientset.PrependReactor("update", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.NewNotFound(schema.GroupResource{Resource: "pods"}, pod.Name)
+	})
+
+	before, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+
+	if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+		t.Errorf("got error %v for a deleted pod, want none", err)
+	}
+
+	after, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+	if got := after.failed - before.failed; got != 0 {
+		t.Errorf("got %.0f failed pods, want 0", got)
+	}
+
+	recorder := podInitializer.recorder.(*record.FakeRecorder)
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("got event %q for a deleted pod", event)
+	default:
+	}
+}
+
+func TestInitializeSelf(t *testing.T) {
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		serviceAccount string
+		wantSkip       bool
+	}{
+		{
+			name:     "self-labeled",
+			labels:   map[string]string{"app": "istio-initializer"},
+			wantSkip: true,
+		},
+		{
+			name:           "own service account",
+			labels:         map[string]string{"app": "reviews"},
+			serviceAccount: "istio-initializer-service-account",
+			wantSkip:       true,
+		},
+		{
+			name:           "other pod",
+			labels:         map[string]string{"app": "reviews"},
+			serviceAccount: "default",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Labels = tt.labels
+			pod.Spec.ServiceAccountName = tt.serviceAccount
+
+			podInitializer, clientset := newTestInitializer(pod)
+			podInitializer.selfSelector = labels.SelectorFromSet(labels.Set{"app": "istio-initializer"})
+			podInitializer.selfServiceAccount = "istio-initializer-service-account"
+
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+
+			updates := podUpdates(clientset)
+			if len(updates) != 1 {
+				t.Fatalf("got %d pod updates, want 1", len(updates))
+			}
+			if got := pendingNames(updates[0]); len(got) != 0 {
+				t.Errorf("got pending initializers %v, want none", got)
+			}
+			if tt.wantSkip {
+				checkNotInjected(t, pod, updates[0])
+				return
+			}
+			if !hasContainer(updates[0].Spec.Containers, defaultProxyContainerName) {
+				t.Errorf("container %s was not injected", defaultProxyContainerName)
+			}
+		})
+	}
+}
+
+func TestInjectionPrecedence(t *testing.T) {
+	// Pods are selected by the istio-injection=enabled namespace label, and
+	// the disabled namespace also opts out with its annotation.
+	namespaces := map[string]*corev1.Namespace{
+		"selected": {ObjectMeta: metav1.ObjectMeta{
+			Name:   "selected",
+			Labels: map[string]string{"istio-injection": "enabled"},
+		}},
+		"unselected": {ObjectMeta: metav1.ObjectMeta{
+			Name: "unselected",
+		}},
+		"disabled": {ObjectMeta: metav1.ObjectMeta{
+			Name:        "disabled",
+			Labels:      map[string]string{"istio-injection": "enabled"},
+			Annotations: map[string]string{namespaceInjectAnnotation: policyDisabled},
+		}},
+	}
+
+	var objects []runtime.Object
+	for name, ns := range namespaces {
+		objects = append(objects, ns, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: testMeshConfig, Namespace: name},
+		})
+	}
+
+	tests := []struct {
+		podInject  string
+		namespace  string
+		policy     string
+		wantInject bool
+	}{
+		{"false", "selected", policyEnabled, false},
+		{"false", "selected", policyDisabled, false},
+		{"false", "unselected", policyEnabled, false},
+		{"false", "unselected", policyDisabled, false},
+		{"false", "disabled", policyEnabled, false},
+		{"false", "disabled", policyDisabled, false},
+		{"true", "selected", policyEnabled, true},
+		{"true", "selected", policyDisabled, true},
+		{"true", "unselected", policyEnabled, true},
+		{"true", "unselected", policyDisabled, true},
+		{"true", "disabled", policyEnabled, true},
+		{"true", "disabled", policyDisabled, true},
+		{"", "selected", policyEnabled, true},
+		{"", "selected", policyDisabled, false},
+		{"", "unselected", policyEnabled, false},
+		{"", "unselected", policyDisabled, false},
+		{"", "disabled", policyEnabled, false},
+		{"", "disabled", policyDisabled, false},
+	}
+
+	podInitializer, _ := newTestInitializer(objects...)
+
+	for _, tt := range tests {
+		name := fmt.Sprintf("pod inject=%q, namespace %s, policy %s", tt.podInject, tt.namespace, tt.policy)
+		t.Run(name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Namespace = tt.namespace
+			if tt.podInject != "" {
+				pod.Annotations = map[string]string{injectAnnotation: tt.podInject}
+			}
+
+			c := newTestConfig(t, map[string]string{
+				"namespaceSelector": "istio-injection=enabled",
+				"policy":            tt.policy,
+			})
+
+			skipReason, err := podInitializer.skipInjection(pod, c)
+			if err != nil {
+				t.Fatalf("skipInjection: %v", err)
+			}
+			if got := skipReason == ""; got != tt.wantInject {
+				t.Errorf("got inject %v (skip reason %q), want %v", got, skipReason, tt.wantInject)
+			}
+		})
+	}
+}
+
+func TestBootstrapOverride(t *testing.T) {
+	bootstrap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "custom-bootstrap", Namespace: testNamespace},
+	}
+
+	tests := []struct {
+		name       string
+		annotation string
+		want       bool
+	}{
+		{
+			name: "no annotation",
+		},
+		{
+			name:       "existing configmap",
+			annotation: bootstrap.Name,
+			want:       true,
+		},
+		{
+			name:       "missing configmap",
+			annotation: "missing",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			if tt.annotation != "" {
+				pod.Annotations = map[string]string{bootstrapOverrideAnnotation: tt.annotation}
+			}
+
+			podInitializer, clientset := newTestInitializer(pod, bootstrap)
+			if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+				t.Fatalf("initializePod: %v", err)
+			}
+			updates := podUpdates(clientset)
+			if len(updates) != 1 {
+				t.Fatalf("got %d pod updates, want 1", len(updates))
+			}
+			updated := updates[0]
+
+			proxy := findContainer(updated.Spec.Containers, defaultProxyContainerName)
+			if proxy == nil {
+				t.Fatalf("container %s was not injected", defaultProxyContainerName)
+			}
+
+			volume := findVolume(updated.Spec.Volumes, bootstrapVolumeName)
+			if got := volume != nil; got != tt.want {
+				t.Errorf("got volume %s injected %v, want %v", bootstrapVolumeName, got, tt.want)
+			}
+			if volume != nil && (volume.ConfigMap == nil || volume.ConfigMap.Name != bootstrap.Name) {
+				t.Errorf("got volume %+v, want configmap %s", volume, bootstrap.Name)
+			}
+			if got := hasVolumeMount(proxy.VolumeMounts, bootstrapVolumeName); got != tt.want {
+				t.Errorf("got volume %s mounted %v, want %v", bootstrapVolumeName, got, tt.want)
+			}
+			if got := containsString(proxy.Args, "--templateFile"); got != tt.want {
+				t.Errorf("got --templateFile in args %v, want %v", proxy.Args, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitForInitializers(t *testing.T) {
+	data := map[string]string{
+		"requireFirst":               "false",
+		"waitForInitializers":        "a.example.com",
+		"waitForInitializersTimeout": "30s",
+	}
+
+	t.Run("wait then proceed", func(t *testing.T) {
+		pod := newPendingPod("a.example.com", defaultInitializerName)
+		pod.CreationTimestamp = metav1.Now()
+		podInitializer, clientset := newTestInitializer(pod)
+		c := newTestConfig(t, data)
+
+		err := podInitializer.initializePod(pod.DeepCopy(), c)
+		requeue, ok := err.(*requeueError)
+		if !ok {
+			t.Fatalf("got error %v, want a requeue", err)
+		}
+		if requeue.after <= 0 || requeue.after > 30*time.Second {
+			t.Errorf("got requeue after %v, want at most the 30s timeout", requeue.after)
+		}
+		if got := len(podUpdates(clientset)); got != 0 {
+			t.Fatalf("got %d pod updates while waiting, want 0", got)
+		}
+
+		// The other initializer removes itself.
+		released := pod.DeepCopy()
+		released.Initializers.Pending = released.Initializers.Pending[1:]
+		if err := clientset.Tracker().Update(corev1.SchemeGroupVersion.WithResource("pods"), released, testNamespace); err != nil {
+			t.Fatalf("updating the stored pod: %v", err)
+		}
+
+		if err := podInitializer.initializePod(released.DeepCopy(), c); err != nil {
+			t.Fatalf("initializePod: %v", err)
+		}
+		updates := podUpdates(clientset)
+		if len(updates) != 1 {
+			t.Fatalf("got %d pod updates, want 1", len(updates))
+		}
+		if !hasContainer(updates[0].Spec.Containers, defaultProxyContainerName) {
+			t.Errorf("container %s was not injected", defaultProxyContainerName)
+		}
+		if got := pendingNames(updates[0]); len(got) != 0 {
+			t.Errorf("got pending initializers %v, want none", got)
+		}
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		pod := newPendingPod("a.example.com", defaultInitializerName)
+		pod.CreationTimestamp = metav1.NewTime(time.Now().Add(-time.Minute))
+		podInitializer, clientset := newTestInitializer(pod)
+
+		if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, data)); err != nil {
+			t.Fatalf("initializePod: %v", err)
+		}
+		updates := podUpdates(clientset)
+		if len(updates) != 1 {
+			t.Fatalf("got %d pod updates after the timeout, want 1", len(updates))
+		}
+		if !hasContainer(updates[0].Spec.Containers, defaultProxyContainerName) {
+			t.Errorf("container %s was not injected", defaultProxyContainerName)
+		}
+		if got, want := pendingNames(updates[0]), []string{"a.example.com"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got pending initializers %v, want %v", got, want)
+		}
+	})
+}
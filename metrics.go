@@ -0,0 +1,164 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const metricsNamespace = "istio_initializer"
+
+// Reasons reported by the pods_skipped_total metric.
+const (
+	skipReasonAlreadyInjected     = "already_injected"
+	skipReasonAnnotation          = "annotation"
+	skipReasonHostNetwork         = "host_network"
+	skipReasonMeshConfig          = "mesh_config"
+	skipReasonNamespace           = "namespace"
+	skipReasonNamespaceAnnotation = "namespace_annotation"
+	skipReasonOwnerKind           = "owner_kind"
+	skipReasonPhase               = "phase"
+	skipReasonPodSelector         = "pod_selector"
+	skipReasonPolicy              = "policy"
+	skipReasonSelf                = "self"
+)
+
+var (
+	podsInjected = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_injected_total",
+		Help:      "Number of pods the sidecar was injected into.",
+	})
+
+	podsSkipped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_skipped_total",
+		Help:      "Number of pods initialized without sidecar injection.",
+	}, []string{"reason"})
+
+	updateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "update_errors_total",
+		Help:      "Number of pods that failed to update, after retrying conflicts.",
+	})
+
+	injectionDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "injection_duration_seconds",
+		Help:      "Time spent initializing a pod, including the update round-trip.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	configReloads = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_total",
+		Help:      "Number of configmap reloads attempted.",
+	})
+
+	configReloadErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_reload_errors_total",
+		Help:      "Number of configmap reloads that failed and kept the last good config.",
+	})
+
+	configLastReload = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "config_last_reload_timestamp_seconds",
+		Help:      "Unix time of the last successful configmap reload.",
+	})
+
+	podsOutOfDate = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "pods_out_of_date",
+		Help:      "Number of injected pods whose config version differs from the current config.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(podsInjected, podsSkipped, updateErrors, injectionDuration,
+		configReloads, configReloadErrors, configLastReload, podsOutOfDate)
+}
+
+// processingStats are the pods processed since startup, read from the
+// counters backing the metrics.
+type processingStats struct {
+	injected float64
+	failed   float64
+	skipped  map[string]float64
+}
+
+// gatherStats reads the processing statistics from the gathered metrics.
+func gatherStats(gatherer prometheus.Gatherer) (processingStats, error) {
+	stats := processingStats{skipped: make(map[string]float64)}
+
+	families, err := gatherer.Gather()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, family := range families {
+		for _, m := range family.GetMetric() {
+			switch family.GetName() {
+			case metricsNamespace + "_pods_injected_total":
+				stats.injected = m.GetCounter().GetValue()
+			case metricsNamespace + "_update_errors_total":
+				stats.failed = m.GetCounter().GetValue()
+			case metricsNamespace + "_pods_skipped_total":
+				for _, label := range m.GetLabel() {
+					if label.GetName() == "reason" {
+						stats.skipped[label.GetValue()] = m.GetCounter().GetValue()
+					}
+				}
+			}
+		}
+	}
+	return stats, nil
+}
+
+func (s processingStats) String() string {
+	var total float64
+	var reasons []string
+	for reason, count := range s.skipped {
+		total += count
+		reasons = append(reasons, fmt.Sprintf("%s=%.0f", reason, count))
+	}
+	sort.Strings(reasons)
+
+	return fmt.Sprintf("%.0f injected, %.0f skipped (%s), %.0f failed",
+		s.injected, total, strings.Join(reasons, ", "), s.failed)
+}
+
+// logSummary logs the pods processed since startup.
+func logSummary() {
+	stats, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		log.Printf("warning: failed to gather the processing statistics: %v", err)
+		return
+	}
+	log.Printf("Processed pods since startup: %s", stats)
+}
+
+// serveMetrics serves the prometheus metrics endpoint on addr.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Printf("Serving metrics on %s/metrics", addr)
+	log.Fatal(http.ListenAndServe(addr, mux))
+}
@@ -0,0 +1,98 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestProcessingStats(t *testing.T) {
+	injected := newPendingPod(defaultInitializerName)
+	injected.Name = "injected"
+
+	skipped := newPendingPod(defaultInitializerName)
+	skipped.Name = "skipped"
+	skipped.Annotations = map[string]string{injectAnnotation: "false"}
+
+	// Conflicts are retried and the pod is injected, they are not failures.
+	conflicted := newPendingPod(defaultInitializerName)
+	conflicted.Name = "conflicted"
+
+	failed := newPendingPod(defaultInitializerName)
+	failed.Name = "failed"
+
+	podInitializer, clientset := newTestInitializer(injected, skipped, conflicted, failed)
+
+	conflicts := 0
+	clientset.PrependReactor("update", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.UpdateAction).GetObject().(*corev1.Pod)
+		switch {
+		case pod.Name == conflicted.Name && conflicts < 2:
+			conflicts++
+			return true, nil, errors.NewConflict(schema.GroupResource{Resource: "pods"}, pod.Name, fmt.Errorf("the object has been modified"))
+		case pod.Name == failed.Name:
+			return true, nil, errors.NewInternalError(fmt.Errorf("update failed"))
+		}
+		return false, nil, nil
+	})
+
+	before, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+
+	c := newTestConfig(t, nil)
+	for _, pod := range []*corev1.Pod{injected, skipped, conflicted} {
+		if err := podInitializer.initializePod(pod.DeepCopy(), c); err != nil {
+			t.Errorf("initializePod %s: %v", pod.Name, err)
+		}
+	}
+	if err := podInitializer.initializePod(failed.DeepCopy(), c); err == nil {
+		t.Errorf("initializePod %s: got no error", failed.Name)
+	}
+
+	after, err := gatherStats(prometheus.DefaultGatherer)
+	if err != nil {
+		t.Fatalf("gatherStats: %v", err)
+	}
+
+	if got := after.injected - before.injected; got != 2 {
+		t.Errorf("got %.0f injected, want 2", got)
+	}
+	if got := after.skipped[skipReasonAnnotation] - before.skipped[skipReasonAnnotation]; got != 1 {
+		t.Errorf("got %.0f skipped for %s, want 1", got, skipReasonAnnotation)
+	}
+	if got := after.failed - before.failed; got != 1 {
+		t.Errorf("got %.0f failed, want 1", got)
+	}
+}
+
+func TestProcessingStatsString(t *testing.T) {
+	stats := processingStats{
+		injected: 3,
+		failed:   1,
+		skipped:  map[string]float64{skipReasonPolicy: 2, skipReasonAnnotation: 1},
+	}
+
+	want := "3 injected, 3 skipped (annotation=1, policy=2), 1 failed"
+	if got := stats.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
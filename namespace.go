@@ -0,0 +1,138 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// namespaceCache serves namespace labels and annotations from a namespace
+// informer so that evaluating the namespace selector and annotation does not
+// require a namespace GET for every pod.
+type namespaceCache struct {
+	clientset kubernetes.Interface
+	lister    corelisters.NamespaceLister
+	informer  cache.Controller
+}
+
+// newNamespaceCache watches the namespaces with watchClientset. Namespaces
+// missing from the informer, because it is not running or has not seen them
+// yet, are fetched with clientset.
+func newNamespaceCache(watchClientset, clientset kubernetes.Interface) *namespaceCache {
+	watchlist := &cache.ListWatch{
+		ListFunc: func(options metav1.ListOptions) (runtime.Object, error) {
+			return watchClientset.CoreV1().Namespaces().List(options)
+		},
+		WatchFunc: func(options metav1.ListOptions) (watch.Interface, error) {
+			return watchClientset.CoreV1().Namespaces().Watch(options)
+		},
+	}
+
+	indexer, informer := cache.NewIndexerInformer(watchlist, &corev1.Namespace{}, 0,
+		cache.ResourceEventHandlerFuncs{}, cache.Indexers{})
+
+	return &namespaceCache{
+		clientset: clientset,
+		lister:    corelisters.NewNamespaceLister(indexer),
+		informer:  informer,
+	}
+}
+
+// run watches the namespaces until stop is closed.
+func (nc *namespaceCache) run(stop <-chan struct{}) {
+	nc.informer.Run(stop)
+}
+
+// labels returns the labels of the named namespace.
+func (nc *namespaceCache) labels(name string) (labels.Set, error) {
+	ns, err := nc.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return labels.Set(ns.Labels), nil
+}
+
+// annotations returns the annotations of the named namespace.
+func (nc *namespaceCache) annotations(name string) (map[string]string, error) {
+	ns, err := nc.get(name)
+	if err != nil {
+		return nil, err
+	}
+	return ns.Annotations, nil
+}
+
+// get returns the named namespace from the informer, falling back to the API
+// server for a namespace the informer has not seen.
+func (nc *namespaceCache) get(name string) (*corev1.Namespace, error) {
+	ns, err := nc.lister.Get(name)
+	if errors.IsNotFound(err) {
+		return nc.clientset.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	}
+	return ns, err
+}
+
+// namespaceFilter is an explicit list of namespaces to inject and namespaces
+// never to inject, set with the -namespace-allowlist and -namespace-denylist
+// flags.
+type namespaceFilter struct {
+	allow []string
+	deny  []string
+}
+
+// allowed reports whether the named namespace passes the filter. The denylist
+// wins over the allowlist, and an empty allowlist allows every namespace.
+func (f namespaceFilter) allowed(namespace string) bool {
+	for _, ns := range f.deny {
+		if ns == namespace {
+			return false
+		}
+	}
+
+	if len(f.allow) == 0 {
+		return true
+	}
+
+	for _, ns := range f.allow {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// namespaceSelected reports whether pods in the named namespace are eligible
+// for sidecar injection. The kube-system and Istio system namespaces are never
+// selected.
+func namespaceSelected(namespace string, c *config, namespaces *namespaceCache) (bool, error) {
+	if namespace == metav1.NamespaceSystem || namespace == c.istioSystem {
+		return false, nil
+	}
+
+	if c.namespaceSelector.Empty() {
+		return true, nil
+	}
+
+	set, err := namespaces.labels(namespace)
+	if err != nil {
+		return false, err
+	}
+
+	return c.namespaceSelector.Matches(set), nil
+}
@@ -0,0 +1,218 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestInjectionPolicy(t *testing.T) {
+	tests := []struct {
+		name          string
+		podInject     string
+		namespaceMode string
+		policy        string
+		want          string
+	}{
+		{
+			name:   "policy enabled",
+			policy: policyEnabled,
+		},
+		{
+			name:   "policy disabled",
+			policy: policyDisabled,
+			want:   skipReasonPolicy,
+		},
+		{
+			name:          "namespace enables over policy",
+			namespaceMode: policyEnabled,
+			policy:        policyDisabled,
+		},
+		{
+			name:          "namespace disables over policy",
+			namespaceMode: policyDisabled,
+			policy:        policyEnabled,
+			want:          skipReasonNamespaceAnnotation,
+		},
+		{
+			name:          "pod enables over namespace",
+			podInject:     "true",
+			namespaceMode: policyDisabled,
+			policy:        policyDisabled,
+		},
+		{
+			name:          "pod disables over namespace",
+			podInject:     "false",
+			namespaceMode: policyEnabled,
+			policy:        policyEnabled,
+			want:          skipReasonAnnotation,
+		},
+		{
+			name:      "pod disables over policy",
+			podInject: "false",
+			policy:    policyEnabled,
+			want:      skipReasonAnnotation,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			namespace := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "annotated"}}
+			if tt.namespaceMode != "" {
+				namespace.Annotations = map[string]string{namespaceInjectAnnotation: tt.namespaceMode}
+			}
+
+			pod := newPendingPod(defaultInitializerName)
+			pod.Namespace = namespace.Name
+			if tt.podInject != "" {
+				pod.Annotations = map[string]string{injectAnnotation: tt.podInject}
+			}
+
+			podInitializer, _ := newTestInitializer(namespace)
+			c := newTestConfig(t, map[string]string{"policy": tt.policy})
+
+			got, err := podInitializer.injectionPolicy(pod, c)
+			if err != nil {
+				t.Fatalf("injectionPolicy: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got skip reason %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNamespaceCache(t *testing.T) {
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: "watched", Labels: map[string]string{"istio-injection": "enabled"}},
+	})
+	namespaces := newNamespaceCache(clientset, clientset)
+
+	// Before the informer runs, namespaces are fetched from the API server.
+	set, err := namespaces.labels("watched")
+	if err != nil {
+		t.Fatalf("labels: %v", err)
+	}
+	if set.Get("istio-injection") != "enabled" {
+		t.Errorf("got labels %v before the informer ran", set)
+	}
+	if got := namespaceGets(clientset); got != 1 {
+		t.Errorf("got %d namespace GETs before the informer ran, want 1", got)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go namespaces.run(stop)
+	if !cache.WaitForCacheSync(stop, namespaces.informer.HasSynced) {
+		t.Fatal("namespace informer did not sync")
+	}
+
+	clientset.ClearActions()
+	set, err = namespaces.labels("watched")
+	if err != nil {
+		t.Fatalf("labels: %v", err)
+	}
+	if set.Get("istio-injection") != "enabled" {
+		t.Errorf("got labels %v from the informer", set)
+	}
+	if got := namespaceGets(clientset); got != 0 {
+		t.Errorf("got %d namespace GETs with a synced informer, want 0", got)
+	}
+
+	if _, err := namespaces.labels("missing"); err == nil {
+		t.Error("got no error for a missing namespace")
+	}
+}
+
+func namespaceGets(clientset *fake.Clientset) int {
+	var gets int
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" && action.GetResource().Resource == "namespaces" {
+			gets++
+		}
+	}
+	return gets
+}
+
+func TestNamespaceFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     namespaceFilter
+		allowed    []string
+		notAllowed []string
+	}{
+		{
+			name:    "empty",
+			allowed: []string{"default", "team-a"},
+		},
+		{
+			name:       "allowlist only",
+			filter:     namespaceFilter{allow: []string{"team-a", "team-b"}},
+			allowed:    []string{"team-a", "team-b"},
+			notAllowed: []string{"default"},
+		},
+		{
+			name:       "denylist only",
+			filter:     namespaceFilter{deny: []string{"kube-system", "team-b"}},
+			allowed:    []string{"default", "team-a"},
+			notAllowed: []string{"kube-system", "team-b"},
+		},
+		{
+			name: "denylist wins over allowlist",
+			filter: namespaceFilter{
+				allow: []string{"team-a", "team-b"},
+				deny:  []string{"team-b"},
+			},
+			allowed:    []string{"team-a"},
+			notAllowed: []string{"team-b", "default"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, namespace := range tt.allowed {
+				if !tt.filter.allowed(namespace) {
+					t.Errorf("namespace %s is not allowed", namespace)
+				}
+			}
+			for _, namespace := range tt.notAllowed {
+				if tt.filter.allowed(namespace) {
+					t.Errorf("namespace %s is allowed", namespace)
+				}
+			}
+		})
+	}
+}
+
+func TestInitializeDeniedNamespace(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	podInitializer, clientset := newTestInitializer(pod)
+	podInitializer.namespaceFilter = namespaceFilter{deny: []string{testNamespace}}
+
+	if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+
+	updates := podUpdates(clientset)
+	if len(updates) != 1 {
+		t.Fatalf("got %d pod updates, want 1", len(updates))
+	}
+	if got := pendingNames(updates[0]); len(got) != 0 {
+		t.Errorf("got pending initializers %v, want none", got)
+	}
+	checkNotInjected(t, pod, updates[0])
+}
@@ -0,0 +1,87 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/mattbaird/jsonpatch"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// createPatch returns the JSON patch that turns the original pod into the
+// mutated one.
+func createPatch(original, mutated *corev1.Pod) ([]byte, error) {
+	originalJSON, err := json.Marshal(original)
+	if err != nil {
+		return nil, err
+	}
+
+	mutatedJSON, err := json.Marshal(mutated)
+	if err != nil {
+		return nil, err
+	}
+
+	operations, err := jsonpatch.CreatePatch(originalJSON, mutatedJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(operations)
+}
+
+// redactedValue replaces the values hidden from logged pod diffs.
+const redactedValue = "<redacted>"
+
+// logPodDiff logs the JSON patch from the original to the mutated pod at
+// verbosity 5. Token volumes and environment variable values are redacted
+// since they may carry credentials.
+func logPodDiff(original, mutated *corev1.Pod) {
+	if !V(5) {
+		return
+	}
+
+	patch, err := createPatch(redactPod(original), redactPod(mutated))
+	if err != nil {
+		V(5).PodPrintf(mutated.Namespace, mutated.Name, err, "failed to compute the pod diff")
+		return
+	}
+	V(5).PodPrintf(mutated.Namespace, mutated.Name, nil, "applying pod diff: %s", patch)
+}
+
+// redactPod returns a copy of the pod with the sources of token and secret
+// volumes dropped and the values of environment variables redacted.
+func redactPod(pod *corev1.Pod) *corev1.Pod {
+	pod = pod.DeepCopy()
+
+	for i := range pod.Spec.Volumes {
+		volume := &pod.Spec.Volumes[i]
+		if volume.Name == tokenVolumeName || volume.Secret != nil || volume.Projected != nil {
+			volume.VolumeSource = corev1.VolumeSource{}
+		}
+	}
+
+	redactEnv(pod.Spec.InitContainers)
+	redactEnv(pod.Spec.Containers)
+	return pod
+}
+
+func redactEnv(containers []corev1.Container) {
+	for i := range containers {
+		for j := range containers[i].Env {
+			if containers[i].Env[j].Value != "" {
+				containers[i].Env[j].Value = redactedValue
+			}
+		}
+	}
+}
@@ -0,0 +1,140 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// patchOperation is a decoded JSON patch operation.
+type patchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value"`
+}
+
+func decodePatch(t *testing.T, patch []byte) []patchOperation {
+	t.Helper()
+
+	var operations []patchOperation
+	if err := json.Unmarshal(patch, &operations); err != nil {
+		t.Fatalf("invalid JSON patch %s: %v", patch, err)
+	}
+	return operations
+}
+
+// containerOperations returns the operations on the pod's containers.
+func containerOperations(operations []patchOperation) []patchOperation {
+	var containers []patchOperation
+	for _, op := range operations {
+		if op.Path == "/spec/containers" || strings.HasPrefix(op.Path, "/spec/containers/") {
+			containers = append(containers, op)
+		}
+	}
+	return containers
+}
+
+func TestCreatePatch(t *testing.T) {
+	original := newPendingPod(defaultInitializerName)
+	mutated := original.DeepCopy()
+	mutated.Spec.Containers = append(mutated.Spec.Containers, corev1.Container{Name: defaultProxyContainerName, Image: "proxy"})
+
+	patch, err := createPatch(original, mutated)
+	if err != nil {
+		t.Fatalf("createPatch: %v", err)
+	}
+
+	operations := decodePatch(t, patch)
+	if len(operations) != 1 {
+		t.Fatalf("got %d patch operations, want 1: %s", len(operations), patch)
+	}
+
+	op := operations[0]
+	if op.Op != "add" || op.Path != "/spec/containers/1" {
+		t.Errorf("got %s %s, want add /spec/containers/1", op.Op, op.Path)
+	}
+	var container corev1.Container
+	if err := json.Unmarshal(op.Value, &container); err != nil || container.Name != defaultProxyContainerName {
+		t.Errorf("got added container %s, want %s", op.Value, defaultProxyContainerName)
+	}
+}
+
+func TestPatchUpdateStrategy(t *testing.T) {
+	pod := newPendingPod(defaultInitializerName)
+	podInitializer, clientset := newTestInitializer(pod)
+	podInitializer.updateStrategy = updateStrategyPatch
+
+	var patches [][]byte
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patches = append(patches, action.(k8stesting.PatchAction).GetPatch())
+		return true, pod, nil
+	})
+
+	if err := podInitializer.initializePod(pod.DeepCopy(), newTestConfig(t, nil)); err != nil {
+		t.Fatalf("initializePod: %v", err)
+	}
+	if got := len(podUpdates(clientset)); got != 0 {
+		t.Errorf("got %d pod updates with the patch strategy, want 0", got)
+	}
+	if len(patches) != 1 {
+		t.Fatalf("got %d pod patches, want 1", len(patches))
+	}
+
+	// The app container is left alone, only the proxy is added.
+	operations := containerOperations(decodePatch(t, patches[0]))
+	if len(operations) != 1 {
+		t.Fatalf("got %d container operations, want 1: %s", len(operations), patches[0])
+	}
+	if op := operations[0]; op.Op != "add" || op.Path != "/spec/containers/1" {
+		t.Errorf("got %s %s, want add /spec/containers/1", op.Op, op.Path)
+	}
+	var container corev1.Container
+	if err := json.Unmarshal(operations[0].Value, &container); err != nil || container.Name != defaultProxyContainerName {
+		t.Errorf("got added container %s, want %s", operations[0].Value, defaultProxyContainerName)
+	}
+}
+
+func TestLogPodDiff(t *testing.T) {
+	var out bytes.Buffer
+	log.SetOutput(&out)
+	defer log.SetOutput(os.Stderr)
+
+	setVerbosity(5)
+	defer setVerbosity(2)
+
+	original := newPendingPod(defaultInitializerName)
+	injected := injectTestPod(t, original, map[string]string{
+		"tokenAudience": "spiffe://cluster.local",
+	})
+
+	logPodDiff(original, injected)
+	diff := out.String()
+
+	if !strings.Contains(diff, `"name":"`+defaultProxyContainerName+`"`) {
+		t.Errorf("diff does not add container %s:\n%s", defaultProxyContainerName, diff)
+	}
+	if !strings.Contains(diff, `"name":"`+tokenVolumeName+`"`) {
+		t.Errorf("diff does not add volume %s:\n%s", tokenVolumeName, diff)
+	}
+	if strings.Contains(diff, "spiffe://cluster.local") || strings.Contains(diff, "serviceAccountToken") {
+		t.Errorf("diff does not redact volume %s:\n%s", tokenVolumeName, diff)
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// listPending writes the pods whose first pending initializer is the named
+// initializer to out. When release is true the initializer is also removed
+// from those pods, releasing them without a sidecar.
+func listPending(clientset kubernetes.Interface, namespace, name string, release bool, out io.Writer) error {
+	pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{IncludeUninitialized: true})
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(out, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAMESPACE\tNAME\tAGE")
+
+	var errs []error
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isPendingInitializer(pod, name, true) {
+			continue
+		}
+
+		age := time.Since(pod.CreationTimestamp.Time)
+		fmt.Fprintf(w, "%s\t%s\t%v\n", pod.Namespace, pod.Name, age-age%time.Second)
+
+		if release {
+			removePendingInitializer(pod, name)
+			if _, err := clientset.CoreV1().Pods(pod.Namespace).Update(pod); err != nil {
+				errs = append(errs, fmt.Errorf("failed to release pod %s/%s: %v", pod.Namespace, pod.Name, err))
+			}
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// pendingCounts counts the outcomes of initializePending.
+type pendingCounts struct {
+	initialized int
+	// pending pods are not ready to be initialized yet and were left
+	// pending on the initializer.
+	pending int
+	failed  int
+}
+
+// initializePending initializes every pod currently pending on the
+// initializer once and returns how many were initialized, left pending and
+// failed.
+func initializePending(clientset kubernetes.Interface, namespace string, podInitializer *initializer, c *config) (pendingCounts, error) {
+	var counts pendingCounts
+
+	pods, err := clientset.CoreV1().Pods(namespace).List(metav1.ListOptions{IncludeUninitialized: true})
+	if err != nil {
+		return counts, err
+	}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+		if !isPendingInitializer(pod, podInitializer.name, c.requireFirst) {
+			continue
+		}
+
+		err := podInitializer.initializePod(pod, c)
+		if requeue, ok := err.(*requeueError); ok {
+			counts.pending++
+			V(2).PodPrintf(pod.Namespace, pod.Name, nil, "%s, leaving the pod pending", requeue.reason)
+			continue
+		}
+		if err != nil {
+			counts.failed++
+			V(0).PodPrintf(pod.Namespace, pod.Name, err, "error: failed to initialize pod")
+			continue
+		}
+		counts.initialized++
+	}
+	return counts, nil
+}
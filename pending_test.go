@@ -0,0 +1,78 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestInitializePending(t *testing.T) {
+	initialized := newPendingPod(defaultInitializerName)
+	initialized.Name = "initialized"
+
+	// Pods pending on another initializer first are not ours yet.
+	notFirst := newPendingPod("a.example.com", defaultInitializerName)
+	notFirst.Name = "not-first"
+
+	// The required mesh config and certificate secret are missing from the
+	// other namespace.
+	missingResources := newPendingPod(defaultInitializerName)
+	missingResources.Name = "missing-resources"
+	missingResources.Namespace = "other"
+
+	failing := newPendingPod(defaultInitializerName)
+	failing.Name = "failing"
+
+	podInitializer, clientset := newTestInitializer(initialized, notFirst, missingResources, failing,
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "other"}},
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "istio.default", Namespace: testNamespace}},
+	)
+	clientset.PrependReactor("update", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		pod := action.(k8stesting.UpdateAction).GetObject().(*corev1.Pod)
+		if pod.Name == failing.Name {
+			return true, nil, errors.NewInternalError(fmt.Errorf("update failed"))
+		}
+		return false, nil, nil
+	})
+
+	c := newTestConfig(t, map[string]string{"preInjectionChecks": "true"})
+
+	counts, err := initializePending(clientset, "", podInitializer, c)
+	if err != nil {
+		t.Fatalf("initializePending: %v", err)
+	}
+
+	want := pendingCounts{initialized: 1, pending: 1, failed: 1}
+	if counts != want {
+		t.Errorf("got %+v, want %+v", counts, want)
+	}
+
+	updated := make(map[string]bool)
+	for _, pod := range podUpdates(clientset) {
+		updated[pod.Name] = true
+	}
+	if !updated[initialized.Name] {
+		t.Errorf("pod %s was not updated", initialized.Name)
+	}
+	for _, name := range []string{notFirst.Name, missingResources.Name} {
+		if updated[name] {
+			t.Errorf("pod %s was updated", name)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// pprofShutdownTimeout bounds the wait for in-flight profiles on shutdown.
+const pprofShutdownTimeout = 5 * time.Second
+
+// pprofServer serves the net/http/pprof handlers. The handlers are registered
+// on a dedicated mux so they are never exposed on the metrics or health
+// addresses.
+type pprofServer struct {
+	server *http.Server
+}
+
+func newPprofServer(addr string) *pprofServer {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	return &pprofServer{server: &http.Server{Addr: addr, Handler: mux}}
+}
+
+// serve serves the profiles until shutdown is called.
+func (p *pprofServer) serve() {
+	log.Printf("Serving pprof on %s/debug/pprof/", p.server.Addr)
+	if err := p.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// shutdown stops the server, waiting up to pprofShutdownTimeout for running
+// profiles to finish.
+func (p *pprofServer) shutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), pprofShutdownTimeout)
+	defer cancel()
+
+	if err := p.server.Shutdown(ctx); err != nil {
+		log.Printf("warning: pprof server shutdown: %v", err)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"log"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// permission is an API access the initializer needs. An empty namespace means
+// all namespaces.
+type permission struct {
+	verb      string
+	resource  string
+	namespace string
+}
+
+func (p permission) String() string {
+	if p.namespace == "" {
+		return fmt.Sprintf("%s %s", p.verb, p.resource)
+	}
+	return fmt.Sprintf("%s %s in namespace %s", p.verb, p.resource, p.namespace)
+}
+
+// permissionFlags are the command line flags deciding which accesses the
+// initializer needs.
+type permissionFlags struct {
+	mode                 string
+	updateStrategy       string
+	podNamespace         string
+	configmapNamespace   string
+	leaderElectNamespace string
+
+	// configFile is set when the config is read from a file instead of the
+	// configmaps.
+	configFile bool
+	driftScan  bool
+	once       bool
+}
+
+// requiredPermissions returns the accesses the initializer needs with the
+// given config and flags, each listed once.
+func requiredPermissions(c *config, flags permissionFlags) []permission {
+	var permissions []permission
+	seen := make(map[permission]bool)
+	add := func(verb, resource, namespace string) {
+		p := permission{verb: verb, resource: resource, namespace: namespace}
+		if !seen[p] {
+			seen[p] = true
+			permissions = append(permissions, p)
+		}
+	}
+
+	// Namespace labels and annotations select the pods to inject, and the
+	// mesh config, certificate secret, bootstrap override and required
+	// resources are looked up in the pod's namespace. A long running
+	// initializer watches the namespaces, and only fetches the ones its
+	// informer has not seen yet.
+	add("get", "namespaces", "")
+	if !flags.once {
+		add("list", "namespaces", "")
+		add("watch", "namespaces", "")
+	}
+	add("get", "configmaps", flags.podNamespace)
+	add("get", "secrets", flags.podNamespace)
+
+	// Only a long running initializer watches the configmaps for changes.
+	if !flags.configFile {
+		add("get", "configmaps", flags.configmapNamespace)
+		if !flags.once {
+			add("list", "configmaps", flags.configmapNamespace)
+			add("watch", "configmaps", flags.configmapNamespace)
+		}
+	}
+
+	if c.autoDetectIPRanges && c.includeIPRanges == "" {
+		add("get", "configmaps", kubeadmConfigMapNamespace)
+	}
+
+	if flags.mode == modeWebhook && !flags.once {
+		if flags.driftScan {
+			add("list", "pods", flags.podNamespace)
+		}
+		return permissions
+	}
+
+	updateVerb := "update"
+	if flags.updateStrategy == updateStrategyPatch {
+		updateVerb = "patch"
+	}
+
+	add("get", "pods", flags.podNamespace)
+	add("list", "pods", flags.podNamespace)
+	add(updateVerb, "pods", flags.podNamespace)
+	add("create", "events", flags.podNamespace)
+	add("patch", "events", flags.podNamespace)
+	if flags.once {
+		return permissions
+	}
+
+	add("watch", "pods", flags.podNamespace)
+
+	// The leader election lock is a configmap, and lock changes are
+	// recorded as events on it.
+	add("get", "configmaps", flags.leaderElectNamespace)
+	add("create", "configmaps", flags.leaderElectNamespace)
+	add("update", "configmaps", flags.leaderElectNamespace)
+	add("create", "events", flags.leaderElectNamespace)
+	add("patch", "events", flags.leaderElectNamespace)
+	return permissions
+}
+
+// checkPermissions reviews the required permissions with the API server and
+// logs every missing one, so that a missing RBAC rule fails with an
+// actionable message rather than an opaque Forbidden error. Failed reviews
+// are retried, only permissions the API server denies are fatal.
+func checkPermissions(clientset kubernetes.Interface, permissions []permission) error {
+	var missing []permission
+	err := retryStartup("checking the RBAC permissions", func() error {
+		var err error
+		missing, err = missingPermissions(clientset, permissions)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, p := range missing {
+		log.Printf("error: missing RBAC: %s", p)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%d required permissions are missing", len(missing))
+	}
+	return nil
+}
+
+// missingPermissions returns the permissions the API server denies.
+func missingPermissions(clientset kubernetes.Interface, permissions []permission) ([]permission, error) {
+	var missing []permission
+	for _, p := range permissions {
+		review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(&authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Verb:      p.verb,
+					Resource:  p.resource,
+					Namespace: p.namespace,
+				},
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to review access to %s: %v", p, err)
+		}
+
+		if !review.Status.Allowed {
+			missing = append(missing, p)
+		}
+	}
+	return missing, nil
+}
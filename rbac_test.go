@@ -0,0 +1,154 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestRequiredPermissions(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    map[string]string
+		flags   permissionFlags
+		want    []string
+		notWant []string
+	}{
+		{
+			name: "initializer",
+			flags: permissionFlags{
+				mode:                 modeInitializer,
+				updateStrategy:       updateStrategyUpdate,
+				configmapNamespace:   "istio-system",
+				leaderElectNamespace: "istio-system",
+			},
+			want: []string{
+				"get namespaces",
+				"list namespaces",
+				"watch namespaces",
+				"get configmaps",
+				"get secrets",
+				"list configmaps in namespace istio-system",
+				"watch configmaps in namespace istio-system",
+				"watch pods",
+				"update pods",
+				"create events",
+				"patch events",
+				"create configmaps in namespace istio-system",
+			},
+			notWant: []string{"patch pods"},
+		},
+		{
+			name: "patch update strategy",
+			flags: permissionFlags{
+				mode:           modeInitializer,
+				updateStrategy: updateStrategyPatch,
+			},
+			want:    []string{"patch pods"},
+			notWant: []string{"update pods"},
+		},
+		{
+			name: "config file",
+			flags: permissionFlags{
+				mode:               modeInitializer,
+				configmapNamespace: "istio-system",
+				configFile:         true,
+			},
+			notWant: []string{
+				"get configmaps in namespace istio-system",
+				"list configmaps in namespace istio-system",
+				"watch configmaps in namespace istio-system",
+			},
+		},
+		{
+			name: "once",
+			flags: permissionFlags{
+				mode:                 modeInitializer,
+				updateStrategy:       updateStrategyUpdate,
+				configmapNamespace:   "istio-system",
+				leaderElectNamespace: "istio-system",
+				once:                 true,
+			},
+			want: []string{
+				"get configmaps in namespace istio-system",
+				"list pods",
+				"update pods",
+			},
+			notWant: []string{
+				"watch namespaces",
+				"watch configmaps in namespace istio-system",
+				"watch pods",
+				"create configmaps in namespace istio-system",
+			},
+		},
+		{
+			name: "webhook",
+			flags: permissionFlags{
+				mode: modeWebhook,
+			},
+			want: []string{"get secrets", "get configmaps"},
+			notWant: []string{
+				"list pods",
+				"update pods",
+				"create events",
+			},
+		},
+		{
+			name: "webhook with drift scan",
+			flags: permissionFlags{
+				mode:      modeWebhook,
+				driftScan: true,
+			},
+			want:    []string{"list pods"},
+			notWant: []string{"update pods"},
+		},
+		{
+			name:  "auto-detected IP ranges",
+			data:  map[string]string{"autoDetectIPRanges": "true"},
+			flags: permissionFlags{mode: modeWebhook},
+			want:  []string{"get configmaps in namespace kube-system"},
+		},
+		{
+			name:    "configured IP ranges",
+			data:    map[string]string{"autoDetectIPRanges": "true", "includeIPRanges": "10.0.0.0/8"},
+			flags:   permissionFlags{mode: modeWebhook},
+			notWant: []string{"get configmaps in namespace kube-system"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestConfig(t, tt.data)
+
+			got := make(map[string]int)
+			for _, p := range requiredPermissions(c, tt.flags) {
+				got[p.String()]++
+			}
+
+			for p, count := range got {
+				if count > 1 {
+					t.Errorf("permission %q listed %d times", p, count)
+				}
+			}
+			for _, p := range tt.want {
+				if got[p] == 0 {
+					t.Errorf("missing permission %q", p)
+				}
+			}
+			for _, p := range tt.notWant {
+				if got[p] > 0 {
+					t.Errorf("unexpected permission %q", p)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+)
+
+// configStore holds the current config. It is swapped atomically whenever
+// the istio initializer configmap changes.
+type configStore struct {
+	mu sync.RWMutex
+	c  *config
+}
+
+func newConfigStore(c *config) *configStore {
+	setVerbosity(c.verbosity)
+	logPolicy(c)
+	return &configStore{c: c}
+}
+
+func (s *configStore) get() *config {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.c
+}
+
+func (s *configStore) set(c *config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c = c
+	setVerbosity(c.verbosity)
+	logPolicy(c)
+}
+
+// logPolicy warns loudly while injection is disabled, since pods are then
+// released without a sidecar unless their annotations opt them in.
+func logPolicy(c *config) {
+	if c.policy == policyDisabled {
+		log.Printf("warning: injection policy is %s, pods not opted in by annotation are released without a sidecar", policyDisabled)
+	}
+}
+
+// newConfigMapInformer returns a controller that watches the named configmaps
+// and reloads the config held by store on every change, merging the
+// configmaps in order. The last good config is kept when the updated
+// configmaps fail to parse.
+func newConfigMapInformer(clientset *kubernetes.Clientset, namespace string, names []string, store *configStore, resyncPeriod time.Duration) cache.Controller {
+	// A field selector matches a single name, so several configmaps are
+	// filtered client side.
+	selector := fields.Everything()
+	if len(names) == 1 {
+		selector = fields.OneTermEqualSelector("metadata.name", names[0])
+	}
+	watchlist := cache.NewListWatchFromClient(clientset.Core().RESTClient(), "configmaps", namespace, selector)
+
+	watched := make(map[string]bool)
+	for _, name := range names {
+		watched[name] = true
+	}
+
+	var cmStore cache.Store
+	var controller cache.Controller
+	reload := func() {
+		// The initial list delivers the configmaps one at a time, merging
+		// them before all are listed would replace the startup config with
+		// a partial one.
+		if !controller.HasSynced() {
+			return
+		}
+
+		configReloads.Inc()
+
+		var cms []*corev1.ConfigMap
+		for _, name := range names {
+			obj, exists, err := cmStore.GetByKey(namespace + "/" + name)
+			if err != nil || !exists {
+				continue
+			}
+			cms = append(cms, obj.(*corev1.ConfigMap))
+		}
+
+		if len(cms) == 0 {
+			configReloadErrors.Inc()
+			log.Printf("failed to reload configmaps %s/%s, keeping the last good config: none of the configmaps exist", namespace, strings.Join(names, ","))
+			return
+		}
+
+		c, err := configmapToConfig(cms...)
+		if err == nil {
+			err = c.validate()
+		}
+		if err != nil {
+			configReloadErrors.Inc()
+			log.Printf("failed to reload configmaps %s/%s, keeping the last good config: %v", namespace, strings.Join(names, ","), err)
+			return
+		}
+
+		c.detectIPRanges(clientset)
+		store.set(c)
+		configLastReload.SetToCurrentTime()
+		log.Printf("Reloaded configuration from configmaps %s/%s", namespace, strings.Join(names, ","))
+	}
+
+	cmStore, controller = cache.NewInformer(watchlist, &corev1.ConfigMap{}, resyncPeriod,
+		cache.ResourceEventHandlerFuncs{
+			AddFunc: func(obj interface{}) {
+				if watched[obj.(*corev1.ConfigMap).Name] {
+					reload()
+				}
+			},
+			UpdateFunc: func(oldObj, newObj interface{}) {
+				oldCM := oldObj.(*corev1.ConfigMap)
+				newCM := newObj.(*corev1.ConfigMap)
+
+				// Periodic resyncs deliver updates for unchanged objects.
+				if oldCM.ResourceVersion == newCM.ResourceVersion || !watched[newCM.Name] {
+					return
+				}
+				reload()
+			},
+			// Deleting a configmap drops its keys from the merged config.
+			DeleteFunc: func(obj interface{}) {
+				key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				_, name, err := cache.SplitMetaNamespaceKey(key)
+				if err != nil {
+					log.Println(err)
+					return
+				}
+				if watched[name] {
+					reload()
+				}
+			},
+		})
+
+	return controller
+}
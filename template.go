@@ -0,0 +1,85 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"text/template"
+
+	"github.com/ghodss/yaml"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// sidecarTemplateData is the data the sidecar template is executed with.
+type sidecarTemplateData struct {
+	Hub                string
+	IncludeIPRanges    string
+	ProxyContainerName string
+	ProxyImage         string
+	ProxyInitImage     string
+	SidecarProxyUID    int64
+	Tag                string
+	Verbosity          int
+	Version            string
+
+	Pod *corev1.Pod
+}
+
+// sidecarTemplateSpec is the result of executing the sidecar template.
+type sidecarTemplateSpec struct {
+	Containers     []corev1.Container `json:"containers"`
+	InitContainers []corev1.Container `json:"initContainers"`
+}
+
+func parseSidecarTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+
+	// Pods without a label or annotation the template looks up render it
+	// empty instead of failing.
+	tmpl, err := template.New("sidecar").Option("missingkey=zero").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template: %v", err)
+	}
+	return tmpl, nil
+}
+
+// renderSidecarTemplate executes the sidecar template for the pod and
+// unmarshals the resulting YAML into the containers to inject.
+func renderSidecarTemplate(tmpl *template.Template, pod *corev1.Pod, c *config) (*sidecarTemplateSpec, error) {
+	data := sidecarTemplateData{
+		Hub:                c.hub,
+		IncludeIPRanges:    includeIPRanges(pod, c),
+		ProxyContainerName: c.proxyContainerName,
+		ProxyImage:         c.proxyImage(),
+		ProxyInitImage:     c.proxyInitImage(),
+		SidecarProxyUID:    c.sidecarProxyUID,
+		Tag:                c.tag,
+		Verbosity:          c.verbosity,
+		Version:            c.version,
+		Pod:                pod,
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, fmt.Errorf("failed to execute template: %v", err)
+	}
+
+	var spec sidecarTemplateSpec
+	if err := yaml.Unmarshal(buf.Bytes(), &spec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal rendered template: %v", err)
+	}
+	return &spec, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestSidecarTemplatePodLabels(t *testing.T) {
+	const text = `containers:
+- name: {{ .ProxyContainerName }}
+  image: {{ .ProxyImage }}
+  args: ["--serviceCluster", "{{ .Pod.Labels.app }}"]
+`
+	c := newTestConfig(t, map[string]string{"template": text})
+	if err := c.validate(); err != nil {
+		t.Fatalf("validate: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "labeled pod", labels: map[string]string{"app": "reviews"}, want: "reviews"},
+		{name: "unlabeled pod", want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pod := newPendingPod(defaultInitializerName)
+			pod.Labels = tt.labels
+
+			spec, err := renderSidecarTemplate(c.sidecarTemplate, pod, c)
+			if err != nil {
+				t.Fatalf("renderSidecarTemplate: %v", err)
+			}
+			if len(spec.Containers) != 1 || len(spec.Containers[0].Args) != 2 {
+				t.Fatalf("got containers %+v, want one container with two args", spec.Containers)
+			}
+			if got := spec.Containers[0].Args[1]; got != tt.want {
+				t.Errorf("got service cluster %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSidecarTemplateInvalid(t *testing.T) {
+	c := newTestConfig(t, map[string]string{"template": "containers:\n- name: {{ .Unknown }}\n"})
+	if err := c.validate(); err == nil {
+		t.Error("got no error for a template using an unknown field")
+	}
+}
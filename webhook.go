@@ -0,0 +1,136 @@
+// Copyright 2017 Google Inc. All Rights Reserved.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//     http://www.apache.org/licenses/LICENSE-2.0
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	admissionv1beta1 "k8s.io/api/admission/v1beta1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// webhook injects the sidecar through a mutating admission webhook instead
+// of an initializer, for clusters where initializers are not available. It
+// shares the injection logic with the initializer.
+type webhook struct {
+	configs     *configStore
+	initializer *initializer
+}
+
+// serve serves the webhook over HTTPS on addr.
+func (wh *webhook) serve(addr, certFile, keyFile string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/inject", wh.handleAdmissionReview)
+
+	log.Printf("Serving the admission webhook on %s/inject", addr)
+	log.Fatal(http.ListenAndServeTLS(addr, certFile, keyFile, mux))
+}
+
+func (wh *webhook) handleAdmissionReview(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "expected Content-Type application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var review admissionv1beta1.AdmissionReview
+	if err := json.NewDecoder(r.Body).Decode(&review); err != nil {
+		http.Error(w, fmt.Sprintf("could not decode admission review: %v", err), http.StatusBadRequest)
+		return
+	}
+	if review.Request == nil {
+		http.Error(w, "admission review has no request", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = wh.admit(review.Request, wh.configs.get())
+	review.Response.UID = review.Request.UID
+
+	out, err := json.Marshal(review)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("could not encode admission review: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// admit runs the same injection as initializePod on the pod in the request
+// and returns the changes as a JSON patch. Pods are always admitted, errors
+// only prevent the injection.
+func (wh *webhook) admit(req *admissionv1beta1.AdmissionRequest, c *config) *admissionv1beta1.AdmissionResponse {
+	var pod corev1.Pod
+	if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+		return admissionError(fmt.Errorf("could not decode pod: %v", err))
+	}
+
+	// Pods created from a template have no namespace set yet.
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
+
+	V(2).PodPrintf(pod.Namespace, pod.Name, nil, "admitting pod")
+
+	c = c.forPod(&pod)
+
+	skipReason, err := wh.initializer.skipInjection(&pod, c)
+	if err != nil {
+		return admissionError(err)
+	}
+	if skipReason != "" {
+		podsSkipped.WithLabelValues(skipReason).Inc()
+		wh.initializer.audit.record(&pod, auditDecisionSkipped, skipReason, c)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	wh.initializer.checkCertSecret(&pod, c)
+	c = wh.initializer.bootstrapOverride(&pod, c)
+
+	mutated, err := injectSidecar(&pod, c)
+	if err != nil {
+		return admissionError(err)
+	}
+
+	patch, err := createPatch(&pod, mutated)
+	if err != nil {
+		return admissionError(err)
+	}
+
+	if wh.initializer.dryRun || c.dryRun {
+		V(2).PodPrintf(pod.Namespace, pod.Name, nil, "dry-run: patch:\n%s", patch)
+		return &admissionv1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	podsInjected.Inc()
+	wh.initializer.audit.record(&pod, auditDecisionInjected, "", c)
+
+	patchType := admissionv1beta1.PatchTypeJSONPatch
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed:   true,
+		Patch:     patch,
+		PatchType: &patchType,
+	}
+}
+
+func admissionError(err error) *admissionv1beta1.AdmissionResponse {
+	log.Printf("error: admission webhook: %v", err)
+	return &admissionv1beta1.AdmissionResponse{
+		Allowed: true,
+		Result: &metav1.Status{
+			Message: err.Error(),
+		},
+	}
+}